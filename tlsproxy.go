@@ -22,30 +22,54 @@ Protocol: HTTP/1.1 only (no HTTP/2 support)
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math/big"
+	mrand "math/rand/v2"
+	"mime"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -63,6 +87,20 @@ type ProxyConfig struct {
 }
 
 type CertConfig struct {
+	Port        int
+	MonitorPort int
+	CertDir     string
+	SkipInstall bool
+	Verbose     bool
+	WatchConfig bool
+
+	ProxyBind      string
+	MonitorBind    string
+	AllowedClients []string
+	ProxyUsername  string
+	ProxyPassword  string
+	MonitorToken   string
+
 	Organization      string
 	CommonName        string
 	ValidityYears     int
@@ -73,10 +111,59 @@ type CertConfig struct {
 	HostValidityDays  int
 	IncludeAIAInHosts bool
 	IncludeCDPInHosts bool
+	KeyPoolSize       int
+	DiskCache         bool
+	CacheMaxEntries   int
+	RenewBeforeDays   int
+	MimicUpstream     string
+
+	UseIntermediate          bool
+	IntermediateCommonName   string
+	IntermediateValidityDays int
+	ImportCert               string
+	ImportKey                string
+	ImportP12                string
+	ImportP12Password        string
+
+	RevocationResponder bool
+	ResponderAddr       string
+	ResponderURL        string
+	OCSPStapling        bool
+
+	CTEnabled     bool
+	CTDefaultMode string
+	CTLogCount    int
+	CTHostModes   []hostPatternSetting
+
+	CertFaults []hostPatternSetting
+
+	DNSServer string
+	DNSHosts  []hostPatternSetting
+
+	InstallNSS           bool
+	InstallJava          bool
+	JavaKeystore         string
+	JavaKeystorePassword string
+	LinuxTrustLayout     string
+	UserTrust            bool
+	TrustDryRun          bool
+
+	BuiltinModules bool
+	Modules        []*moduleConfig
 }
 
 func defaultCertConfig() *CertConfig {
 	return &CertConfig{
+		Port:        8080,
+		MonitorPort: 4040,
+		CertDir:     ".",
+		WatchConfig: true,
+
+		ProxyBind:   "127.0.0.1",
+		MonitorBind: "127.0.0.1",
+
+		BuiltinModules: true,
+
 		Organization:      "TLS Proxy CA",
 		CommonName:        "TLS Proxy Root CA",
 		ValidityYears:     10,
@@ -87,25 +174,100 @@ func defaultCertConfig() *CertConfig {
 		HostValidityDays:  365,
 		IncludeAIAInHosts: false,
 		IncludeCDPInHosts: false,
+		KeyPoolSize:       8,
+		DiskCache:         false,
+		CacheMaxEntries:   1000,
+		RenewBeforeDays:   7,
+		MimicUpstream:     mimicOff,
+
+		UseIntermediate:          false,
+		IntermediateValidityDays: 30,
+
+		RevocationResponder: false,
+		ResponderAddr:       "127.0.0.1:8889",
+		OCSPStapling:        false,
+
+		CTEnabled:     false,
+		CTDefaultMode: ctValid,
+		CTLogCount:    2,
+
+		InstallNSS:           true,
+		InstallJava:          false,
+		JavaKeystorePassword: javaKeystorePassword,
+		LinuxTrustLayout:     "auto",
 	}
 }
 
 type CertCache struct {
 	sync.RWMutex
-	certs map[string]*tls.Certificate
+	certs      map[string]*cachedCert
+	lru        *list.List
+	inflight   map[string]*certCall
+	maxEntries int
+
+	// dir is set when leaves are also persisted to disk
+	dir    string
+	diskMu sync.Mutex
+
+	hits         atomic.Int64
+	misses       atomic.Int64
+	shared       atomic.Int64
+	renewals     atomic.Int64
+	evictions    atomic.Int64
+	generated    atomic.Int64
+	genTimeTotal atomic.Int64
+	genTimeMax   atomic.Int64
+}
+
+type cachedCert struct {
+	hostname      string
+	cert          *tls.Certificate
+	leaf          *x509.Certificate
+	caFingerprint string
+	lastUsed      time.Time
+	element       *list.Element
+
+	// faulty leaves are broken on purpose: they are never renewed for
+	// expiry and never written to disk
+	faulty bool
+}
+
+// certCall is a leaf generation in progress. Concurrent requests for the
+// same hostname wait on done instead of minting their own certificate.
+type certCall struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
 }
 
 var (
-	caCert      *x509.Certificate
-	caKey       *rsa.PrivateKey
-	certCache   = &CertCache{certs: make(map[string]*tls.Certificate)}
-	certConfig  *CertConfig
+	certCache   = &CertCache{certs: make(map[string]*cachedCert), lru: list.New(), inflight: make(map[string]*certCall)}
+	leafKeyPool *KeyPool
 	logMutex    sync.Mutex
 	logWriter   *os.File
-	logModules  []LogModule
-	verboseMode bool
 )
 
+// The running configuration and module chain are swapped as a whole on
+// reload; each request reads whichever snapshot is current when it starts.
+var (
+	activeConfig  atomic.Pointer[CertConfig]
+	activeModules atomic.Pointer[pipeline]
+
+	// moduleBuild collects RegisterModule calls during initializeModules
+	moduleBuild pipeline
+)
+
+func currentConfig() *CertConfig {
+	return activeConfig.Load()
+}
+
+func currentPipeline() *pipeline {
+	if p := activeModules.Load(); p != nil {
+		return p
+	}
+	return &pipeline{}
+}
+
 type LogModule interface {
 	Name() string
 	ShouldLog(req *http.Request) bool
@@ -113,33 +275,374 @@ type LogModule interface {
 	ProcessResponse(resp *http.Response) error
 }
 
+// ExchangeModule is version 2 of LogModule. It sees the whole exchange and
+// can end it: setting a response in HandleRequest (Exchange.Respond) skips
+// the upstream, and returning ErrDropExchange or ErrAbortExchange stops
+// the exchange. Other errors are logged and the chain carries on.
+type ExchangeModule interface {
+	Name() string
+	HandleRequest(x *Exchange) error
+	HandleResponse(x *Exchange) error
+}
+
+// ScopeFilter decides which exchanges are captured. Filters don't see the
+// traffic themselves; observers (proxy.log, the monitor, token capture)
+// only see exchanges inside the scope.
+type ScopeFilter interface {
+	Name() string
+	Matches(x *Exchange) bool
+}
+
+var (
+	// ErrDropExchange closes the client connection without a response.
+	ErrDropExchange = errors.New("exchange dropped")
+	// ErrAbortExchange answers 502 Bad Gateway and closes the connection.
+	ErrAbortExchange = errors.New("exchange aborted")
+	// ErrResetExchange resets the client connection (TCP RST).
+	ErrResetExchange = errors.New("exchange reset")
+)
+
+// logModuleAdapter runs a v1 LogModule in the v2 chain.
+type logModuleAdapter struct {
+	LogModule
+}
+
+func (a logModuleAdapter) HandleRequest(x *Exchange) error {
+	return a.ProcessRequest(x.Request)
+}
+
+func (a logModuleAdapter) HandleResponse(x *Exchange) error {
+	return a.ProcessResponse(x.Response)
+}
+
+// ShouldLogFilter turns a v1 module's ShouldLog into a scope filter.
+func ShouldLogFilter(m LogModule) ScopeFilter {
+	return shouldLogFilter{m}
+}
+
+type shouldLogFilter struct {
+	LogModule
+}
+
+func (f shouldLogFilter) Matches(x *Exchange) bool {
+	return f.ShouldLog(x.Request)
+}
+
+// pipeline is the module chain plus the capture scope. Observers are
+// skipped for exchanges outside the scope; other modules see everything.
+type pipeline struct {
+	modules []pipelineModule
+	scope   captureScope
+}
+
+type pipelineModule struct {
+	ExchangeModule
+	observer bool
+}
+
+// RegisterModule adds a v1 module. Modules that implement ScopeFilter
+// (DomainFilter, PathFilter, OAuth) become include filters; the rest run
+// on every exchange and their ShouldLog is not consulted.
 func RegisterModule(module LogModule) {
-	logModules = append(logModules, module)
+	if filter, ok := module.(ScopeFilter); ok {
+		RegisterFilter(filter, false, "")
+		return
+	}
+	RegisterExchangeModule(logModuleAdapter{module})
+}
+
+func RegisterExchangeModule(module ExchangeModule) {
+	moduleBuild.modules = append(moduleBuild.modules, pipelineModule{ExchangeModule: module})
 	log.Printf("[MODULE] Registered: %s", module.Name())
 }
 
-func executeModules(req *http.Request) bool {
-	shouldLog := false
-	for _, module := range logModules {
-		if module.ShouldLog(req) {
-			shouldLog = true
+// RegisterObserver adds a module that records traffic and so only sees
+// exchanges inside the capture scope.
+func RegisterObserver(module ExchangeModule) {
+	moduleBuild.modules = append(moduleBuild.modules, pipelineModule{ExchangeModule: module, observer: true})
+	log.Printf("[MODULE] Registered observer: %s", module.Name())
+}
+
+// RegisterFilter adds a filter to the capture scope. Filters sharing a
+// group must all match (AND); groups are alternatives (OR). An empty group
+// puts the filter in a group of its own.
+func RegisterFilter(filter ScopeFilter, exclude bool, group string) {
+	moduleBuild.scope.add(filter, exclude, group)
+	kind := "include"
+	if exclude {
+		kind = "exclude"
+	}
+	log.Printf("[MODULE] Registered %s filter: %s", kind, filter.Name())
+}
+
+// executeModules runs the request side of the chain. Once a module has
+// answered the request, the remaining modules are skipped.
+func executeModules(x *Exchange) error {
+	p := currentPipeline()
+	x.pipeline = p
+	x.InScope = p.scope.Contains(x)
+	for _, module := range p.modules {
+		if x.Response != nil {
+			break
+		}
+		if module.observer && !x.InScope {
+			continue
 		}
-		if err := module.ProcessRequest(req); err != nil {
+		if err := module.HandleRequest(x); err != nil {
+			if isExchangeStop(err) {
+				log.Printf("[%s] %v: %s", module.Name(), err, x.Request.URL)
+				return err
+			}
 			log.Printf("[%s] Error processing request: %v", module.Name(), err)
 		}
+		if x.Response != nil {
+			log.Printf("[%s] Answered %s without contacting upstream", module.Name(), x.Request.URL)
+		}
 	}
-	return shouldLog
+	return nil
 }
 
-func executeModulesResponse(resp *http.Response) error {
-	for _, module := range logModules {
-		if err := module.ProcessResponse(resp); err != nil {
+func executeModulesResponse(x *Exchange) error {
+	p := x.pipeline
+	if p == nil {
+		p = currentPipeline()
+	}
+	for _, module := range p.modules {
+		if module.observer && !x.InScope {
+			continue
+		}
+		if err := module.HandleResponse(x); err != nil {
+			if isExchangeStop(err) {
+				log.Printf("[%s] %v: %s", module.Name(), err, x.Request.URL)
+				return err
+			}
 			log.Printf("[%s] Error processing response: %v", module.Name(), err)
 		}
 	}
 	return nil
 }
 
+func isExchangeStop(err error) bool {
+	return errors.Is(err, ErrDropExchange) || errors.Is(err, ErrAbortExchange) || errors.Is(err, ErrResetExchange)
+}
+
+// captureScope decides whether an exchange is captured. A matching exclude
+// group always wins. Otherwise the exchange is in scope if any include
+// group matches, or if there are no include groups at all.
+type captureScope struct {
+	groups []*scopeGroup
+}
+
+// scopeGroup matches when all of its filters match.
+type scopeGroup struct {
+	name    string
+	exclude bool
+	filters []ScopeFilter
+}
+
+func (s *captureScope) add(filter ScopeFilter, exclude bool, group string) {
+	if group != "" {
+		for _, g := range s.groups {
+			if g.name == group && g.exclude == exclude {
+				g.filters = append(g.filters, filter)
+				return
+			}
+		}
+	}
+	s.groups = append(s.groups, &scopeGroup{name: group, exclude: exclude, filters: []ScopeFilter{filter}})
+}
+
+func (g *scopeGroup) matches(x *Exchange) bool {
+	for _, f := range g.filters {
+		if !f.Matches(x) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *captureScope) Contains(x *Exchange) bool {
+	hasInclude, included := false, false
+	for _, g := range s.groups {
+		if g.exclude {
+			if g.matches(x) {
+				return false
+			}
+			continue
+		}
+		hasInclude = true
+		included = included || g.matches(x)
+	}
+	return !hasInclude || included
+}
+
+// ============================================================================
+// EXCHANGE CONTEXT
+// ============================================================================
+
+var exchangeSeq atomic.Uint64
+
+// Exchange is one request/response pair as it moves through the proxy.
+type Exchange struct {
+	ID         uint64
+	ClientAddr string
+	// TLS is the client side of an intercepted HTTPS connection; nil for
+	// plain HTTP.
+	TLS *tls.ConnectionState
+
+	Request  *http.Request
+	Response *http.Response
+	// Synthetic is set when a module answered instead of the upstream.
+	Synthetic bool
+	// InScope is decided once, before any module runs, so proxy.log, the
+	// monitor and token capture all agree on it.
+	InScope bool
+
+	// ClientURL is the URL as the client sent it. MapType says which
+	// module redirected or answered the request: "local" or "remote" (a
+	// map rule), "mock", "fault" (a network profile) or "blocked".
+	// MapTarget is where a map rule sent it, or the rule that answered.
+	ClientURL string
+	MapType   string
+	MapTarget string
+
+	// UpstreamIP is the address the request was sent to; ResolvedBy says
+	// where it came from ("override", the [dns] server, "system").
+	UpstreamIP string
+	ResolvedBy string
+
+	Start      time.Time
+	ResponseAt time.Time
+
+	// pipeline is the module chain the request side ran with; the
+	// response side reuses it even if a reload swapped the chain since.
+	pipeline *pipeline
+
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+func newExchange(req *http.Request, clientAddr string, state *tls.ConnectionState) *Exchange {
+	return &Exchange{
+		ID:         exchangeSeq.Add(1),
+		ClientAddr: clientAddr,
+		TLS:        state,
+		Request:    req,
+		ClientURL:  req.URL.String(),
+		Start:      time.Now(),
+	}
+}
+
+// Set stores a value for later modules in the same exchange.
+func (x *Exchange) Set(key string, value interface{}) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.values == nil {
+		x.values = make(map[string]interface{})
+	}
+	x.values[key] = value
+}
+
+func (x *Exchange) Get(key string) (interface{}, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	value, ok := x.values[key]
+	return value, ok
+}
+
+// Duration is the time from reading the request to having a response.
+func (x *Exchange) Duration() time.Duration {
+	if x.ResponseAt.IsZero() {
+		return time.Since(x.Start)
+	}
+	return x.ResponseAt.Sub(x.Start)
+}
+
+// TLSVersion names the client's TLS version, or "" for plain HTTP.
+func (x *Exchange) TLSVersion() string {
+	if x.TLS == nil {
+		return ""
+	}
+	return tls.VersionName(x.TLS.Version)
+}
+
+// Respond answers the request without contacting the upstream.
+func (x *Exchange) Respond(status int, header http.Header, body string) {
+	if header == nil {
+		header = make(http.Header)
+	}
+	x.Response = &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       x.Request,
+	}
+	x.Synthetic = true
+}
+
+// serveExchange runs one request through the module chain and the upstream
+// and writes the response. It reports whether the connection can carry
+// another request.
+func serveExchange(w io.Writer, x *Exchange, config *ProxyConfig) bool {
+	// Before a module can read the request body
+	leg := upstreamLeg(w)
+	err := executeModules(x)
+	if x.InScope {
+		logRequest(x.Request, config)
+	}
+	if err != nil {
+		return stopExchange(w, err)
+	}
+
+	if x.Response == nil {
+		dial := &upstreamDial{leg: leg}
+		resp, err := forwardRequest(x.Request.WithContext(context.WithValue(x.Request.Context(), upstreamDialKey{}, dial)))
+		x.UpstreamIP, x.ResolvedBy = dial.IP, dial.Source
+		if err != nil {
+			log.Printf("Failed to forward request: %v", err)
+			w.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return false
+		}
+		x.Response = resp
+	}
+	x.ResponseAt = time.Now()
+	upstream := x.Response
+	defer upstream.Body.Close()
+
+	if err := executeModulesResponse(x); err != nil {
+		return stopExchange(w, err)
+	}
+	if x.Response != upstream {
+		defer x.Response.Body.Close()
+	}
+
+	if err := x.Response.Write(w); err != nil {
+		if errors.Is(err, ErrResetExchange) {
+			resetConnection(w)
+		} else if !errors.Is(err, errNetworkTruncate) && err != io.EOF && !strings.Contains(err.Error(), "broken pipe") {
+			log.Printf("Failed to write response: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+func stopExchange(w io.Writer, err error) bool {
+	if errors.Is(err, ErrResetExchange) {
+		resetConnection(w)
+	}
+	if errors.Is(err, ErrAbortExchange) {
+		msg := err.Error() + "\r\n"
+		fmt.Fprintf(w, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(msg), msg)
+	}
+	return false
+}
+
 // ============================================================================
 // TOKEN STRUCTURES AND EXPORTS
 // ============================================================================
@@ -939,6 +1442,10 @@ type TrafficEntry struct {
 	Duration        time.Duration
 	TLSVersion      string
 	ClientAddr      string
+	MapType         string
+	MapTarget       string
+	UpstreamIP      string
+	ResolvedBy      string
 }
 
 type TrafficStore struct {
@@ -1017,19 +1524,15 @@ func (m *MonitoringModule) Name() string {
 	return "Monitor"
 }
 
-func (m *MonitoringModule) ShouldLog(req *http.Request) bool {
-	return true
-}
-
-func (m *MonitoringModule) ProcessRequest(req *http.Request) error {
+func (m *MonitoringModule) HandleRequest(x *Exchange) error {
 	return nil
 }
 
-func (m *MonitoringModule) ProcessResponse(resp *http.Response) error {
-	startTime := time.Now()
+func (m *MonitoringModule) HandleResponse(x *Exchange) error {
+	resp := x.Response
 
 	entry := TrafficEntry{
-		Timestamp:       startTime,
+		Timestamp:       x.Start,
 		Method:          resp.Request.Method,
 		URL:             resp.Request.URL.String(),
 		Host:            resp.Request.URL.Hostname(),
@@ -1039,7 +1542,19 @@ func (m *MonitoringModule) ProcessResponse(resp *http.Response) error {
 		RequestHeaders:  cloneHeaders(resp.Request.Header),
 		ResponseHeaders: cloneHeaders(resp.Header),
 		ContentType:     resp.Header.Get("Content-Type"),
-		ClientAddr:      "",
+		Duration:        x.Duration(),
+		TLSVersion:      x.TLSVersion(),
+		ClientAddr:      x.ClientAddr,
+		MapType:         x.MapType,
+		MapTarget:       x.MapTarget,
+		UpstreamIP:      x.UpstreamIP,
+		ResolvedBy:      x.ResolvedBy,
+	}
+	if x.MapType != "" {
+		// Show what the client asked for; MapTarget says where it went
+		if u, err := url.Parse(x.ClientURL); err == nil {
+			entry.URL, entry.Host, entry.Path = x.ClientURL, u.Hostname(), u.Path
+		}
 	}
 
 	if m.captureResponseBodies && resp.Body != nil {
@@ -1047,7 +1562,6 @@ func (m *MonitoringModule) ProcessResponse(resp *http.Response) error {
 
 		if encoding == "br" || encoding == "zstd" || encoding == "deflate" {
 			entry.ResponseBody = fmt.Sprintf("[Content compressed with %s - cannot display]", encoding)
-			entry.Duration = time.Since(startTime)
 			trafficStore.AddEntry(entry)
 			return nil
 		}
@@ -1088,7 +1602,6 @@ func (m *MonitoringModule) ProcessResponse(resp *http.Response) error {
 		}
 	}
 
-	entry.Duration = time.Since(startTime)
 	trafficStore.AddEntry(entry)
 
 	return nil
@@ -1106,18 +1619,30 @@ func cloneHeaders(h http.Header) map[string][]string {
 // WEB MONITOR SERVER (existing code - keeping it the same)
 // ============================================================================
 
-func StartMonitorServer(port int) {
+func StartMonitorServer(bind string, port int) {
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/api/entries", handleAPIEntries)
 	http.HandleFunc("/api/entry/", handleAPIEntry)
 	http.HandleFunc("/api/clear", handleAPIClear)
 	http.HandleFunc("/api/stats", handleAPIStats)
-
-	addr := fmt.Sprintf(":%d", port)
-	log.Printf("[MONITOR] Starting monitor server on http://localhost%s", addr)
+	http.HandleFunc("/api/certs", handleAPICerts)
+	http.HandleFunc("/api/upstream-certs/", handleAPIUpstreamCerts)
+	http.HandleFunc("/api/revocations", handleAPIRevocations)
+	http.HandleFunc("/api/ct", handleAPICT)
+	http.HandleFunc("/api/cert-faults", handleAPICertFaults)
+	http.HandleFunc("/api/reload", handleAPIReload)
+	http.HandleFunc("/api/scripts", handleAPIScripts)
+	http.HandleFunc("/api/rules", handleAPIRules)
+	http.HandleFunc("/api/mocks", handleAPIMocks)
+	http.HandleFunc("/api/network", handleAPINetwork)
+	http.HandleFunc("/ct/v1/add-chain", handleCTAddChain)
+	http.HandleFunc("/ct/v1/add-pre-chain", handleCTAddChain)
+
+	addr := net.JoinHostPort(bind, strconv.Itoa(port))
+	log.Printf("[MONITOR] Starting monitor server on http://%s", addr)
 
 	go func() {
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		if err := http.ListenAndServe(addr, protectMonitor(http.DefaultServeMux)); err != nil {
 			log.Printf("[MONITOR] Server error: %v", err)
 		}
 	}()
@@ -1184,6 +1709,49 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             color: #333;
         }
         
+        .script-errors {
+            display: none;
+            background: #fdecea;
+            color: #b71c1c;
+            padding: 10px 30px;
+            border-bottom: 1px solid #f5c6cb;
+            font-family: monospace;
+            font-size: 13px;
+            white-space: pre-wrap;
+        }
+        
+        .rules-panel {
+            display: none;
+            background: #fff;
+            padding: 10px 30px;
+            border-bottom: 1px solid #e0e0e0;
+            font-size: 13px;
+        }
+        
+        .rules-panel summary {
+            cursor: pointer;
+            font-weight: 600;
+        }
+        
+        .rules-panel table {
+            margin-top: 8px;
+            width: 100%;
+        }
+        
+        .rules-panel td {
+            padding: 4px 8px;
+            font-family: monospace;
+        }
+        
+        .rules-panel textarea {
+            display: block;
+            width: 100%;
+            min-height: 200px;
+            margin: 8px 0;
+            font-family: monospace;
+            font-size: 12px;
+        }
+        
         .controls {
             background: #fff;
             padding: 15px 30px;
@@ -1310,6 +1878,17 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         .status.client-error { color: #f57c00; }
         .status.server-error { color: #d32f2f; }
         
+        .mapped {
+            display: inline-block;
+            margin-right: 6px;
+            padding: 1px 5px;
+            border-radius: 3px;
+            background: #ede7f6;
+            color: #5e35b1;
+            font-size: 10px;
+            font-weight: 600;
+        }
+        
         .url {
             color: #1976d2;
             word-break: break-all;
@@ -1684,6 +2263,23 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         </div>
     </div>
     
+    <div class="script-errors" id="scriptErrors"></div>
+    
+    <details class="rules-panel" id="rulesPanel">
+        <summary id="rulesSummary">Rules</summary>
+        <table><tbody id="rulesTable"></tbody></table>
+    </details>
+    
+    <details class="rules-panel" id="networkPanel">
+        <summary id="networkSummary">Network</summary>
+        <table><tbody id="networkTable"></tbody></table>
+    </details>
+    
+    <details class="rules-panel" id="mocksPanel">
+        <summary>Mocks</summary>
+        <div id="mocksEditors"></div>
+    </details>
+    
     <div class="controls">
         <input type="text" id="searchBox" placeholder="Filter by URL, host, method, or status...">
         <label>
@@ -1773,11 +2369,77 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                 
                 renderTable(filtered);
                 updateStats(entries);
+                loadScriptErrors();
+                loadRules();
+                loadNetwork();
             } catch (error) {
                 console.error('Failed to load entries:', error);
             }
         }
         
+        async function loadRules() {
+            const panel = document.getElementById('rulesPanel');
+            const rules = await (await fetch('/api/rules')).json();
+            panel.style.display = rules.length ? 'block' : 'none';
+            const hits = rules.reduce((sum, r) => sum + r.hits, 0);
+            document.getElementById('rulesSummary').textContent = 'Rules (' + rules.length + ', ' + hits + ' hits)';
+            document.getElementById('rulesTable').innerHTML = rules.map(r =>
+                '<tr><td>' + escapeHtml(r.name) + '</td><td>' + escapeHtml(r.type) + '</td><td>' + escapeHtml(r.description) +
+                '</td><td>' + r.hits + ' hits' + (r.replacements ? ', ' + r.replacements + ' replacements' : '') +
+                (r.skipped ? ', ' + r.skipped + ' skipped' : '') + '</td><td>' +
+                (r.hits ? new Date(r.last_hit).toLocaleTimeString() : '') + '</td></tr>').join('');
+        }
+        
+        async function loadNetwork() {
+            const profiles = await (await fetch('/api/network')).json();
+            document.getElementById('networkPanel').style.display = profiles.length ? 'block' : 'none';
+            const active = profiles.filter(p => p.active).length;
+            document.getElementById('networkSummary').textContent = 'Network (' + active + ' of ' + profiles.length + ' profiles on)';
+            document.getElementById('networkTable').innerHTML = profiles.map(p =>
+                '<tr><td><label><input type="checkbox"' + (p.active ? ' checked' : '') + ' onchange="toggleNetwork(\'' +
+                encodeURIComponent(p.name) + '\', this.checked)"> ' + escapeHtml(p.name) + '</label></td><td>' + escapeHtml(p.description) +
+                '</td><td>' + p.exchanges + ' exchanges, ' + p.errors + ' 5xx, ' + p.resets + ' resets, ' + p.truncations +
+                ' truncated, ' + p.handshake_failures + ' handshakes failed</td></tr>').join('');
+        }
+        
+        async function toggleNetwork(name, active) {
+            await fetch('/api/network?profile=' + name + '&active=' + active, {method: 'POST', headers: {'Content-Type': 'application/json'}});
+            loadNetwork();
+        }
+        
+        async function loadMocks() {
+            const sets = await (await fetch('/api/mocks')).json();
+            document.getElementById('mocksPanel').style.display = sets.length ? 'block' : 'none';
+            document.getElementById('mocksEditors').innerHTML = sets.map((set, i) =>
+                '<div><b>' + escapeHtml(set.module) + '</b> (' + escapeHtml(set.file) + ') hits: ' + set.hits.join(', ') +
+                '<textarea id="mockText' + i + '">' + escapeHtml(JSON.stringify(set.rules, null, 2)) + '</textarea>' +
+                '<button onclick="saveMocks(' + i + ', \'' + encodeURIComponent(set.module) + '\')">Save</button> ' +
+                '<span id="mockStatus' + i + '">' + escapeHtml(set.load_error || '') + '</span></div>').join('');
+        }
+        
+        async function saveMocks(i, module) {
+            const status = document.getElementById('mockStatus' + i);
+            const response = await fetch('/api/mocks?module=' + module, {method: 'PUT', headers: {'Content-Type': 'application/json'}, body: document.getElementById('mockText' + i).value});
+            const result = await response.json();
+            if (response.ok) {
+                loadMocks();
+            } else {
+                status.textContent = result.error;
+            }
+        }
+        
+        async function loadScriptErrors() {
+            const box = document.getElementById('scriptErrors');
+            const scripts = await (await fetch('/api/scripts')).json();
+            const lines = [];
+            for (const s of scripts) {
+                if (s.load_error) lines.push('Script ' + s.name + ' failed to load (previous version still running): ' + s.load_error);
+                if (s.run_error) lines.push('Script ' + s.name + ' error at ' + new Date(s.run_error_at).toLocaleTimeString() + ' (' + s.run_errors + ' total): ' + s.run_error);
+            }
+            box.textContent = lines.join('\n');
+            box.style.display = lines.length ? 'block' : 'none';
+        }
+        
         function renderTable(entries) {
             const tbody = document.getElementById('trafficTable');
             
@@ -1791,10 +2453,15 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                 const statusClass = getStatusClass(entry.StatusCode);
                 const duration = entry.Duration ? (entry.Duration / 1000000).toFixed(0) + 'ms' : '-';
                 
-                return '<tr onclick="showDetails(' + entry.ID + ')"><td class="timestamp">' + time + '</td><td><span class="method ' + entry.Method + '">' + entry.Method + '</span></td><td>' + escapeHtml(entry.Host) + '</td><td class="url">' + escapeHtml(entry.Path) + '</td><td><span class="status ' + statusClass + '">' + (entry.StatusCode || '-') + '</span></td><td>' + duration + '</td><td>' + (entry.ContentType || '-') + '</td></tr>';
+                return '<tr onclick="showDetails(' + entry.ID + ')"><td class="timestamp">' + time + '</td><td><span class="method ' + entry.Method + '">' + entry.Method + '</span></td><td>' + escapeHtml(entry.Host) + '</td><td class="url">' + mappedBadge(entry) + escapeHtml(entry.Path) + '</td><td><span class="status ' + statusClass + '">' + (entry.StatusCode || '-') + '</span></td><td>' + duration + '</td><td>' + (entry.ContentType || '-') + '</td></tr>';
             }).join('');
         }
         
+        function mappedBadge(entry) {
+            if (!entry.MapType) return '';
+            return '<span class="mapped" title="' + escapeHtml(entry.MapTarget || '') + '">' + escapeHtml(entry.MapType.toUpperCase()) + '</span>';
+        }
+        
         function getStatusClass(code) {
             if (code >= 200 && code < 300) return 'success';
             if (code >= 300 && code < 400) return 'redirect';
@@ -1881,6 +2548,9 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                 html += '<div><div class="label">Host:</div><div class="value">' + escapeHtml(entry.Host) + '</div></div>';
                 html += '<div><div class="label">Path:</div><div class="value">' + escapeHtml(entry.Path) + '</div></div>';
                 html += '<div><div class="label">Timestamp:</div><div class="value">' + new Date(entry.Timestamp).toLocaleString() + '</div></div>';
+                if (entry.MapType) {
+                    html += '<div><div class="label">Mapped:</div><div class="value">' + mappedBadge(entry) + escapeHtml(entry.MapTarget || '') + '</div></div>';
+                }
                 html += '</div></div>';
                 
                 if (entry.StatusCode) {
@@ -1888,6 +2558,9 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                     html += '<div><div class="label">Status:</div><div class="value"><span class="status ' + getStatusClass(entry.StatusCode) + '">' + entry.StatusCode + ' ' + escapeHtml(entry.StatusText) + '</span></div></div>';
                     html += '<div><div class="label">Content-Type:</div><div class="value">' + escapeHtml(entry.ContentType || 'N/A') + '</div></div>';
                     html += '<div><div class="label">Duration:</div><div class="value">' + (entry.Duration ? (entry.Duration / 1000000).toFixed(2) + 'ms' : 'N/A') + '</div></div>';
+                    if (entry.UpstreamIP) {
+                        html += '<div><div class="label">Upstream IP:</div><div class="value">' + escapeHtml(entry.UpstreamIP) + ' (' + escapeHtml(entry.ResolvedBy) + ')</div></div>';
+                    }
                     html += '</div></div>';
                 }
                 
@@ -1901,6 +2574,11 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
                     html += '<div class="detail-section"><h3>Response Body <button class="section-copy-btn" onclick="copyResponseBody(' + id + ', this)">Copy</button></h3><div id="resp-body-' + id + '">' + formatResponseBody(entry.ResponseBody, entry.ContentType) + '</div></div>';
                 }
                 
+                const chainResponse = await fetch('/api/upstream-certs/' + encodeURIComponent(entry.Host));
+                if (chainResponse.ok) {
+                    html += formatCertChain(await chainResponse.json());
+                }
+                
                 modalBody.innerHTML = html;
                 document.getElementById('detailModal').style.display = 'block';
             } catch (error) {
@@ -1909,6 +2587,22 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        function formatCertChain(chain) {
+            let html = '<div class="detail-section"><h3>Upstream Certificate Chain</h3>';
+            chain.forEach((cert, i) => {
+                html += '<div class="detail-grid">';
+                html += '<div><div class="label">[' + i + '] Subject:</div><div class="value">' + escapeHtml(cert.subject) + '</div></div>';
+                html += '<div><div class="label">Issuer:</div><div class="value">' + escapeHtml(cert.issuer) + '</div></div>';
+                html += '<div><div class="label">Valid:</div><div class="value">' + new Date(cert.notBefore).toLocaleString() + ' - ' + new Date(cert.notAfter).toLocaleString() + '</div></div>';
+                html += '<div><div class="label">SHA-256:</div><div class="value">' + escapeHtml(cert.sha256) + '</div></div>';
+                if (cert.dnsNames) {
+                    html += '<div><div class="label">DNS Names:</div><div class="value">' + escapeHtml(cert.dnsNames.join(', ')) + '</div></div>';
+                }
+                html += '</div>';
+            });
+            return html + '</div>';
+        }
+        
         function copyAllHeaders(entryId, type, button) {
             const headersDiv = document.getElementById(type + '-headers-' + entryId);
             if (!headersDiv) return;
@@ -2020,6 +2714,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
         
         startAutoRefresh();
         loadEntries();
+        loadMocks();
     </script>
 </body>
 </html>`
@@ -2075,6 +2770,11 @@ func handleAPIStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+func handleAPICerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(certCache.Stats())
+}
+
 func countByMethod(entries []TrafficEntry) map[string]int {
 	counts := make(map[string]int)
 	for _, entry := range entries {
@@ -2139,6 +2839,10 @@ func (m *AllTrafficModule) ShouldLog(req *http.Request) bool {
 	return true
 }
 
+func (m *AllTrafficModule) Matches(x *Exchange) bool {
+	return m.ShouldLog(x.Request)
+}
+
 func (m *AllTrafficModule) ProcessRequest(req *http.Request) error {
 	return nil
 }
@@ -2179,6 +2883,10 @@ func (m *OAuthModule) ShouldLog(req *http.Request) bool {
 	return false
 }
 
+func (m *OAuthModule) Matches(x *Exchange) bool {
+	return m.ShouldLog(x.Request)
+}
+
 func (m *OAuthModule) ProcessRequest(req *http.Request) error {
 	return nil
 }
@@ -2187,61 +2895,7066 @@ func (m *OAuthModule) ProcessResponse(resp *http.Response) error {
 	return nil
 }
 
-// ... (rest of the existing modules: DomainFilter, RequestModifier, etc.) ...
+// DomainFilterModule only logs specific domains
+type DomainFilterModule struct {
+	Domains []string
+}
 
-// ============================================================================
-// MAIN FUNCTION
-// ============================================================================
+func (m *DomainFilterModule) Name() string {
+	return fmt.Sprintf("DomainFilter(%s)", strings.Join(m.Domains, ","))
+}
 
-func main() {
-	port := flag.Int("port", 8080, "Proxy port")
-	cleanup := flag.Bool("cleanup", false, "Remove CA certificates and exit")
-	certDir := flag.String("certdir", ".", "Certificate directory")
-	skipInstall := flag.Bool("skip-install", false, "Skip automatic certificate installation")
-	configFile := flag.String("config", "proxy-config.ini", "Configuration file path")
-	monitorPort := flag.Int("monitor-port", 4040, "Monitor web interface port")
-	verbose := flag.Bool("verbose", false, "Enable verbose logging (log all traffic to console)")
-	flag.Parse()
+func (m *DomainFilterModule) ShouldLog(req *http.Request) bool {
+	host := req.URL.Hostname()
+	for _, domain := range m.Domains {
+		if strings.Contains(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *DomainFilterModule) Matches(x *Exchange) bool {
+	return m.ShouldLog(x.Request)
+}
 
-	verboseMode = *verbose
+func (m *DomainFilterModule) ProcessRequest(req *http.Request) error {
+	return nil
+}
 
-	certConfig = loadConfig(*configFile)
+func (m *DomainFilterModule) ProcessResponse(resp *http.Response) error {
+	return nil
+}
 
-	config := &ProxyConfig{
-		Port:        *port,
-		CertDir:     *certDir,
-		LogFile:     filepath.Join(*certDir, logFile),
-		SkipInstall: *skipInstall,
-	}
+// RequestModifierModule modifies requests (example: add headers)
+type RequestModifierModule struct {
+	AddHeaders    map[string]string
+	RemoveHeaders []string
+}
 
-	if *cleanup {
-		cleanupCerts(config)
-		return
-	}
+func (m *RequestModifierModule) Name() string {
+	return "RequestModifier"
+}
 
-	if err := initCA(config); err != nil {
-		log.Fatalf("Failed to initialize CA: %v", err)
+func (m *RequestModifierModule) ShouldLog(req *http.Request) bool {
+	return true
+}
+
+func (m *RequestModifierModule) ProcessRequest(req *http.Request) error {
+	// Add custom headers
+	for key, value := range m.AddHeaders {
+		req.Header.Set(key, value)
+		log.Printf("[RequestModifier] Added header: %s: %s", key, value)
 	}
 
-	var err error
-	logWriter, err = os.OpenFile(config.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+	// Remove headers
+	for _, key := range m.RemoveHeaders {
+		if req.Header.Get(key) != "" {
+			req.Header.Del(key)
+			log.Printf("[RequestModifier] Removed header: %s", key)
+		}
 	}
-	defer logWriter.Close()
 
-	initializeModules()
+	return nil
+}
 
-	StartMonitorServer(*monitorPort)
+func (m *RequestModifierModule) ProcessResponse(resp *http.Response) error {
+	return nil
+}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
-	if err != nil {
-		log.Fatalf("Failed to start proxy: %v", err)
-	}
-	defer listener.Close()
+// ResponseModifierModule modifies responses
+type ResponseModifierModule struct {
+	AddHeaders    map[string]string
+	RemoveHeaders []string
+}
+
+func (m *ResponseModifierModule) Name() string {
+	return "ResponseModifier"
+}
+
+func (m *ResponseModifierModule) ShouldLog(req *http.Request) bool {
+	return true
+}
+
+func (m *ResponseModifierModule) ProcessRequest(req *http.Request) error {
+	return nil
+}
+
+func (m *ResponseModifierModule) ProcessResponse(resp *http.Response) error {
+	// Add custom headers
+	for key, value := range m.AddHeaders {
+		resp.Header.Set(key, value)
+		log.Printf("[ResponseModifier] Added header: %s: %s", key, value)
+	}
+
+	// Remove headers
+	for _, key := range m.RemoveHeaders {
+		if resp.Header.Get(key) != "" {
+			resp.Header.Del(key)
+			log.Printf("[ResponseModifier] Removed header: %s", key)
+		}
+	}
+
+	return nil
+}
+
+// PathFilterModule only logs specific URL paths
+type PathFilterModule struct {
+	Paths []string
+}
+
+func (m *PathFilterModule) Name() string {
+	return fmt.Sprintf("PathFilter(%s)", strings.Join(m.Paths, ","))
+}
+
+func (m *PathFilterModule) ShouldLog(req *http.Request) bool {
+	path := req.URL.Path
+	for _, filterPath := range m.Paths {
+		if strings.Contains(path, filterPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *PathFilterModule) Matches(x *Exchange) bool {
+	return m.ShouldLog(x.Request)
+}
+
+func (m *PathFilterModule) ProcessRequest(req *http.Request) error {
+	return nil
+}
+
+func (m *PathFilterModule) ProcessResponse(resp *http.Response) error {
+	return nil
+}
+
+// ============================================================================
+// MODULE PIPELINE
+// ============================================================================
+
+// Each [module.<name>] section in proxy-config.ini adds one module to the
+// chain:
+//
+//	[module.api_only]
+//	type = domain_filter
+//	order = 10
+//	domains = api.example.com, auth.example.com
+//
+// Modules run after the built-in Monitor and TokenExport observers, sorted
+// by order and then by position in the file. With
+// "[modules] builtin = false" the built-ins are left out and can be placed
+// explicitly as monitor and token_export sections. all_traffic is a scope
+// filter, not part of the chain.
+const moduleSectionPrefix = "module."
+
+// moduleConfig is one [module.<name>] section.
+type moduleConfig struct {
+	Name    string
+	Type    string
+	Order   int
+	Enabled bool
+	Params  []moduleParam
+	Source  string
+}
+
+// moduleParam is a type-specific key. Keys may repeat (add_header).
+type moduleParam struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// builtinModuleTypes are registered by default and can only be declared
+// again when [modules] builtin is off.
+var builtinModuleTypes = []string{"monitor", "token_export"}
+
+// configuredModule is what a [module.<name>] section builds: a chain
+// module, an observer or a scope filter.
+type configuredModule struct {
+	module   ExchangeModule
+	observer bool
+
+	filter  ScopeFilter
+	exclude bool
+	group   string
+}
+
+func (c configuredModule) register() {
+	switch {
+	case c.filter != nil:
+		RegisterFilter(c.filter, c.exclude, c.group)
+	case c.observer:
+		RegisterObserver(c.module)
+	default:
+		RegisterExchangeModule(c.module)
+	}
+}
+
+var moduleTypes = map[string]func(p *moduleParams) (configuredModule, error){
+	"all_traffic": func(p *moduleParams) (configuredModule, error) { return p.scopeFilter(&AllTrafficModule{}) },
+	"oauth":       func(p *moduleParams) (configuredModule, error) { return p.scopeFilter(&OAuthModule{}) },
+	"monitor": func(p *moduleParams) (configuredModule, error) {
+		m := NewMonitoringModule()
+		var err error
+		if m.captureRequestBodies, err = p.boolean("capture_request_bodies", m.captureRequestBodies); err != nil {
+			return configuredModule{}, err
+		}
+		if m.captureResponseBodies, err = p.boolean("capture_response_bodies", m.captureResponseBodies); err != nil {
+			return configuredModule{}, err
+		}
+		if m.maxBodySize, err = p.integer("max_body_size", m.maxBodySize); err != nil {
+			return configuredModule{}, err
+		}
+		return configuredModule{module: m, observer: true}, nil
+	},
+	"block":      newBlockModule,
+	"map_local":  newMapLocalModule,
+	"map_remote": newMapRemoteModule,
+	"mock":       newMockModule,
+	"network":    newNetworkModule,
+	"plugin":     newPluginModule,
+	"rewrite":    newRewriteModule,
+	"script":     newScriptModule,
+	"token_export": func(p *moduleParams) (configuredModule, error) {
+		return configuredModule{module: logModuleAdapter{NewTokenExportModule()}, observer: true}, nil
+	},
+	"domain_filter": func(p *moduleParams) (configuredModule, error) {
+		domains := p.list("domains")
+		if len(domains) == 0 {
+			return configuredModule{}, p.missing("domains")
+		}
+		return p.scopeFilter(&DomainFilterModule{Domains: domains})
+	},
+	"path_filter": func(p *moduleParams) (configuredModule, error) {
+		paths := p.list("paths")
+		if len(paths) == 0 {
+			return configuredModule{}, p.missing("paths")
+		}
+		return p.scopeFilter(&PathFilterModule{Paths: paths})
+	},
+	"request_modifier": func(p *moduleParams) (configuredModule, error) {
+		add, err := p.headers("add_header")
+		if err != nil {
+			return configuredModule{}, err
+		}
+		return configuredModule{module: logModuleAdapter{&RequestModifierModule{AddHeaders: add, RemoveHeaders: p.list("remove_headers")}}}, nil
+	},
+	"response_modifier": func(p *moduleParams) (configuredModule, error) {
+		add, err := p.headers("add_header")
+		if err != nil {
+			return configuredModule{}, err
+		}
+		return configuredModule{module: logModuleAdapter{&ResponseModifierModule{AddHeaders: add, RemoveHeaders: p.list("remove_headers")}}}, nil
+	},
+}
+
+func moduleTypeNames() []string {
+	names := make([]string, 0, len(moduleTypes))
+	for name := range moduleTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// moduleSection returns the config for [module.<name>], adding it on first
+// use so the chain keeps file order.
+func (c *CertConfig) moduleSection(name, source string) *moduleConfig {
+	for _, m := range c.Modules {
+		if m.Name == name {
+			return m
+		}
+	}
+	m := &moduleConfig{Name: name, Enabled: true, Source: source}
+	c.Modules = append(c.Modules, m)
+	return m
+}
+
+func setModuleValue(config *CertConfig, name, key, value, source string) error {
+	m := config.moduleSection(name, source)
+	switch key {
+	case "type":
+		m.Type = strings.ToLower(value)
+		if _, ok := moduleTypes[m.Type]; !ok {
+			return fmt.Errorf("unknown module type %q (known: %s)", value, strings.Join(moduleTypeNames(), ", "))
+		}
+	case "order":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("order: %q is not a number", value)
+		}
+		m.Order = n
+	case "enabled":
+		on, err := parseBool(value)
+		if err != nil {
+			return fmt.Errorf("enabled: %v", err)
+		}
+		m.Enabled = on
+	default:
+		m.Params = append(m.Params, moduleParam{Key: key, Value: value, Source: source})
+	}
+	return nil
+}
+
+// moduleParams hands a section's keys to a module constructor and reports
+// the ones it never asked for.
+type moduleParams struct {
+	config *moduleConfig
+	used   map[string]bool
+}
+
+func (p *moduleParams) values(key string) []moduleParam {
+	p.used[key] = true
+	var out []moduleParam
+	for _, param := range p.config.Params {
+		if param.Key == key {
+			out = append(out, param)
+		}
+	}
+	return out
+}
+
+func (p *moduleParams) errorf(source, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: [module.%s] %s", source, p.config.Name, fmt.Sprintf(format, args...))
+}
+
+func (p *moduleParams) missing(key string) error {
+	return p.errorf(p.config.Source, "%s module needs %s", p.config.Type, key)
+}
+
+// list joins comma-separated values across repeated keys.
+func (p *moduleParams) list(key string) []string {
+	var list []string
+	for _, param := range p.values(key) {
+		for _, item := range strings.Split(param.Value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// headers parses repeated "Name: value" lines.
+func (p *moduleParams) headers(key string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, param := range p.values(key) {
+		name, value, ok := strings.Cut(param.Value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, p.errorf(param.Source, "%s: expected \"Name: value\", got %q", key, param.Value)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// scopeFilter reads the mode (include or exclude) and group keys shared by
+// all filter types.
+func (p *moduleParams) scopeFilter(filter ScopeFilter) (configuredModule, error) {
+	c := configuredModule{filter: filter}
+	if param, ok := p.last("mode"); ok {
+		switch strings.ToLower(param.Value) {
+		case "include":
+		case "exclude":
+			c.exclude = true
+		default:
+			return c, p.errorf(param.Source, "mode: %q is not one of include, exclude", param.Value)
+		}
+	}
+	if param, ok := p.last("group"); ok {
+		c.group = param.Value
+	}
+	return c, nil
+}
+
+func (p *moduleParams) last(key string) (moduleParam, bool) {
+	values := p.values(key)
+	if len(values) == 0 {
+		return moduleParam{}, false
+	}
+	return values[len(values)-1], true
+}
+
+func (p *moduleParams) boolean(key string, def bool) (bool, error) {
+	param, ok := p.last(key)
+	if !ok {
+		return def, nil
+	}
+	v, err := parseBool(param.Value)
+	if err != nil {
+		return false, p.errorf(param.Source, "%s: %v", key, err)
+	}
+	return v, nil
+}
+
+func (p *moduleParams) duration(key string, def time.Duration) (time.Duration, error) {
+	param, ok := p.last(key)
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(param.Value)
+	if err != nil || d <= 0 {
+		return 0, p.errorf(param.Source, "%s: %q is not a duration like 500ms or 2s", key, param.Value)
+	}
+	return d, nil
+}
+
+func (p *moduleParams) integer(key string, def int) (int, error) {
+	param, ok := p.last(key)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(param.Value)
+	if err != nil || n < 0 {
+		return 0, p.errorf(param.Source, "%s: %q is not a non-negative number", key, param.Value)
+	}
+	return n, nil
+}
+
+// newConfiguredModule builds the module for one section.
+func newConfiguredModule(mc *moduleConfig) (configuredModule, error) {
+	build, ok := moduleTypes[mc.Type]
+	if !ok {
+		return configuredModule{}, fmt.Errorf("%s: [module.%s] has no type (known: %s)", mc.Source, mc.Name, strings.Join(moduleTypeNames(), ", "))
+	}
+	p := &moduleParams{config: mc, used: make(map[string]bool)}
+	module, err := build(p)
+	if err != nil {
+		return configuredModule{}, err
+	}
+	for _, param := range mc.Params {
+		if !p.used[param.Key] {
+			return configuredModule{}, p.errorf(param.Source, "unknown key %q for %s module", param.Key, mc.Type)
+		}
+	}
+	return module, nil
+}
+
+// orderedModules returns the enabled module sections in chain order.
+func orderedModules(config *CertConfig) []*moduleConfig {
+	var mods []*moduleConfig
+	for _, m := range config.Modules {
+		if m.Enabled {
+			mods = append(mods, m)
+		}
+	}
+	sort.SliceStable(mods, func(i, j int) bool { return mods[i].Order < mods[j].Order })
+	return mods
+}
+
+func validateModules(config *CertConfig) []error {
+	var errs []error
+	for _, mc := range config.Modules {
+		if _, ok := moduleTypes[mc.Type]; !mc.Enabled || (!ok && mc.Type != "") {
+			// Unknown types were reported while parsing.
+			continue
+		}
+		if config.BuiltinModules && slices.Contains(builtinModuleTypes, mc.Type) {
+			errs = append(errs, fmt.Errorf("%s: [module.%s] %s is already in the built-in chain; set [modules] builtin = false to place it yourself", mc.Source, mc.Name, mc.Type))
+			continue
+		}
+		if _, err := newConfiguredModule(mc); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// moduleSignature describes the module sections without source positions,
+// so moving a section around in the file isn't reported as a change.
+func moduleSignature(mods []*moduleConfig) string {
+	var b strings.Builder
+	for _, m := range mods {
+		fmt.Fprintf(&b, "[%s %s %d %t", m.Name, m.Type, m.Order, m.Enabled)
+		for _, p := range m.Params {
+			fmt.Fprintf(&b, " %s=%s", p.Key, p.Value)
+		}
+		b.WriteString("]")
+	}
+	return b.String()
+}
+
+func dumpModules(w io.Writer, config *CertConfig) {
+	for _, m := range config.Modules {
+		fmt.Fprintf(w, "\n# from %s\n", m.Source)
+		fmt.Fprintf(w, "[%s%s]\n", moduleSectionPrefix, m.Name)
+		fmt.Fprintf(w, "type = %s\n", m.Type)
+		fmt.Fprintf(w, "order = %d\n", m.Order)
+		fmt.Fprintf(w, "enabled = %t\n", m.Enabled)
+		for _, p := range m.Params {
+			fmt.Fprintf(w, "%s = %s\n", p.Key, p.Value)
+		}
+	}
+}
+
+// ============================================================================
+// PLUGIN MODULES
+// ============================================================================
+
+// A plugin is an external process (command) or a unix socket server
+// (socket) that gets each exchange as one JSON object per line and answers
+// with a JSON object per line carrying the same id. Replies may arrive in
+// any order.
+//
+//	[module.redact]
+//	type = plugin
+//	command = /usr/local/bin/redact --strict
+//	timeout = 500ms
+//	failure = closed
+const (
+	pluginRetryDelay     = 5 * time.Second
+	pluginDefaultMaxBody = 1 << 20
+)
+
+// pluginHTTP is a request or response as sent to and from plugins. Bodies
+// are base64 encoded, as encoding/json does for []byte.
+type pluginHTTP struct {
+	Method      string      `json:"method,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Headers     http.Header `json:"headers,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+	BodyOmitted bool        `json:"body_omitted,omitempty"`
+}
+
+type pluginExchange struct {
+	ID         uint64 `json:"id"`
+	ClientAddr string `json:"client_addr"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	InScope    bool   `json:"in_scope"`
+	Synthetic  bool   `json:"synthetic,omitempty"`
+}
+
+type pluginMessage struct {
+	ID       uint64         `json:"id"`
+	Phase    string         `json:"phase"`
+	Exchange pluginExchange `json:"exchange"`
+	Request  *pluginHTTP    `json:"request"`
+	Response *pluginHTTP    `json:"response,omitempty"`
+}
+
+// pluginReply is a plugin's answer. Action is one of continue (the
+// default), modify, respond, drop or abort.
+type pluginReply struct {
+	ID       uint64            `json:"id"`
+	Action   string            `json:"action"`
+	Request  *pluginHTTP       `json:"request,omitempty"`
+	Response *pluginHTTP       `json:"response,omitempty"`
+	Values   map[string]string `json:"values,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type pluginSpec struct {
+	Command    []string
+	Socket     string
+	Timeout    time.Duration
+	FailClosed bool
+	Observe    bool
+	Request    bool
+	Response   bool
+	MaxBody    int
+}
+
+func (s pluginSpec) target() string {
+	if s.Socket != "" {
+		return "unix:" + s.Socket
+	}
+	return "exec:" + strings.Join(s.Command, " ")
+}
+
+// PluginModule forwards exchanges to a plugin.
+type PluginModule struct {
+	name   string
+	spec   pluginSpec
+	client *pluginClient
+}
+
+func newPluginModule(p *moduleParams) (configuredModule, error) {
+	spec := pluginSpec{Timeout: 2 * time.Second, Request: true, Response: true}
+	command, hasCommand := p.last("command")
+	socket, hasSocket := p.last("socket")
+	switch {
+	case hasCommand && hasSocket:
+		return configuredModule{}, p.errorf(socket.Source, "command and socket are mutually exclusive")
+	case hasCommand:
+		spec.Command = strings.Fields(command.Value)
+	case hasSocket:
+		spec.Socket = socket.Value
+	default:
+		return configuredModule{}, p.missing("command or socket")
+	}
+
+	var err error
+	if spec.Timeout, err = p.duration("timeout", spec.Timeout); err != nil {
+		return configuredModule{}, err
+	}
+	if spec.Observe, err = p.boolean("observe", false); err != nil {
+		return configuredModule{}, err
+	}
+	if spec.MaxBody, err = p.integer("max_body", pluginDefaultMaxBody); err != nil {
+		return configuredModule{}, err
+	}
+	if param, ok := p.last("failure"); ok {
+		switch strings.ToLower(param.Value) {
+		case "open":
+		case "closed":
+			spec.FailClosed = true
+		default:
+			return configuredModule{}, p.errorf(param.Source, "failure: %q is not one of open, closed", param.Value)
+		}
+	}
+	if phases, ok := p.last("phases"); ok {
+		spec.Request, spec.Response = false, false
+		for _, phase := range p.list("phases") {
+			switch strings.ToLower(phase) {
+			case "request":
+				spec.Request = true
+			case "response":
+				spec.Response = true
+			default:
+				return configuredModule{}, p.errorf(phases.Source, "phases: %q is not one of request, response", phase)
+			}
+		}
+	}
+
+	name := p.config.Name
+	m := &PluginModule{name: name, spec: spec, client: &pluginClient{name: name, spec: spec}}
+	return configuredModule{module: m, observer: spec.Observe}, nil
+}
+
+func (m *PluginModule) Name() string {
+	return fmt.Sprintf("Plugin(%s)", m.name)
+}
+
+func (m *PluginModule) HandleRequest(x *Exchange) error {
+	if !m.spec.Request {
+		return nil
+	}
+	msg := &pluginMessage{Phase: "request", Request: pluginRequest(x.Request, m.spec.MaxBody)}
+	return m.exchange(x, msg)
+}
+
+func (m *PluginModule) HandleResponse(x *Exchange) error {
+	if !m.spec.Response || x.Response == nil {
+		return nil
+	}
+	msg := &pluginMessage{
+		Phase:    "response",
+		Request:  &pluginHTTP{Method: x.Request.Method, URL: x.Request.URL.String(), Headers: x.Request.Header},
+		Response: pluginResponse(x.Response, m.spec.MaxBody),
+	}
+	return m.exchange(x, msg)
+}
+
+func (m *PluginModule) exchange(x *Exchange, msg *pluginMessage) error {
+	msg.Exchange = pluginExchange{
+		ID:         x.ID,
+		ClientAddr: x.ClientAddr,
+		TLSVersion: x.TLSVersion(),
+		InScope:    x.InScope,
+		Synthetic:  x.Synthetic,
+	}
+
+	if m.spec.Observe {
+		if _, err := m.client.call(msg, false); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	reply, err := m.client.call(msg, true)
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	if err == nil {
+		err = m.apply(x, msg.Phase, reply)
+	}
+	if err == nil || isExchangeStop(err) {
+		return err
+	}
+	if m.spec.FailClosed {
+		return fmt.Errorf("%v: %w", err, ErrAbortExchange)
+	}
+	return fmt.Errorf("%v (failing open)", err)
+}
+
+func (m *PluginModule) apply(x *Exchange, phase string, reply pluginReply) error {
+	for key, value := range reply.Values {
+		x.Set(key, value)
+	}
+
+	switch reply.Action {
+	case "", "continue":
+		return nil
+	case "drop":
+		return ErrDropExchange
+	case "abort":
+		return ErrAbortExchange
+	case "respond":
+		r := reply.Response
+		if r == nil {
+			return fmt.Errorf("respond without a response")
+		}
+		status := r.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		x.Respond(status, r.Headers, string(r.Body))
+		return nil
+	case "modify":
+		if phase == "request" {
+			return applyPluginRequest(x.Request, reply.Request)
+		}
+		applyPluginResponse(x.Response, reply.Response)
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", reply.Action)
+}
+
+func pluginRequest(req *http.Request, maxBody int) *pluginHTTP {
+	msg := &pluginHTTP{Method: req.Method, URL: req.URL.String(), Headers: req.Header}
+	if req.Body == nil || req.Body == http.NoBody {
+		return msg
+	}
+	if req.ContentLength > int64(maxBody) || maxBody == 0 {
+		msg.BodyOmitted = true
+		return msg
+	}
+	// Chunked bodies have no length up front: read one byte past the
+	// limit and pass a longer body through unread, as for responses.
+	head, err := io.ReadAll(io.LimitReader(req.Body, int64(maxBody)+1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+	if err != nil || len(head) > maxBody {
+		msg.BodyOmitted = true
+		return msg
+	}
+	if body, err := readAndRestoreRequestBody(req); err == nil {
+		msg.Body = body
+	} else {
+		msg.BodyOmitted = true
+	}
+	return msg
+}
+
+func pluginResponse(resp *http.Response, maxBody int) *pluginHTTP {
+	msg := &pluginHTTP{Status: resp.StatusCode, Headers: resp.Header}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return msg
+	}
+	if resp.ContentLength > int64(maxBody) || maxBody == 0 {
+		msg.BodyOmitted = true
+		return msg
+	}
+	// Read one byte past the limit; a longer body is passed through
+	// unread instead of being buffered.
+	head, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxBody)+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil || len(head) > maxBody {
+		msg.BodyOmitted = true
+		return msg
+	}
+	msg.Body = head
+	return msg
+}
+
+func applyPluginRequest(req *http.Request, r *pluginHTTP) error {
+	if r == nil {
+		return nil
+	}
+	if r.Method != "" {
+		req.Method = r.Method
+	}
+	if r.URL != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("modify: %q is not an absolute URL", r.URL)
+		}
+		req.URL = u
+		req.Host = u.Host
+	}
+	if r.Headers != nil {
+		req.Header = r.Headers
+	}
+	if r.Body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(r.Body))
+		req.ContentLength = int64(len(r.Body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+		req.Header.Del("Transfer-Encoding")
+	}
+	return nil
+}
+
+func applyPluginResponse(resp *http.Response, r *pluginHTTP) {
+	if r == nil {
+		return
+	}
+	if r.Status != 0 {
+		resp.StatusCode = r.Status
+		resp.Status = fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+	}
+	if r.Headers != nil {
+		resp.Header = r.Headers
+	}
+	if r.Body != nil {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(r.Body))
+		resp.ContentLength = int64(len(r.Body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+		resp.Header.Del("Transfer-Encoding")
+		resp.TransferEncoding = nil
+	}
+}
+
+// pluginConn is the write side of a plugin connection: a unix socket or
+// the write end of the plugin's stdin pipe. Both support deadlines, so a
+// plugin that stops reading can't wedge the proxy.
+type pluginConn interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+type pluginResult struct {
+	reply pluginReply
+	err   error
+}
+
+// pluginClient owns the connection to one plugin. It connects on first
+// use and reconnects (at most every pluginRetryDelay) after a failure.
+type pluginClient struct {
+	name string
+	spec pluginSpec
+
+	mu      sync.Mutex
+	conn    pluginConn
+	enc     *json.Encoder
+	cmd     *exec.Cmd
+	pending map[uint64]chan pluginResult
+	nextID  uint64
+	retryAt time.Time
+	closed  bool
+}
+
+func (c *pluginClient) call(msg *pluginMessage, wait bool) (pluginReply, error) {
+	c.mu.Lock()
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			c.mu.Unlock()
+			return pluginReply{}, err
+		}
+	}
+	c.nextID++
+	msg.ID = c.nextID
+	var ch chan pluginResult
+	if wait {
+		ch = make(chan pluginResult, 1)
+		c.pending[msg.ID] = ch
+	}
+	conn := c.conn
+	conn.SetWriteDeadline(time.Now().Add(c.spec.Timeout))
+	if err := c.enc.Encode(msg); err != nil {
+		c.disconnectLocked(conn, err)
+		c.mu.Unlock()
+		return pluginReply{}, err
+	}
+	c.mu.Unlock()
+
+	if !wait {
+		return pluginReply{}, nil
+	}
+
+	timer := time.NewTimer(c.spec.Timeout)
+	defer timer.Stop()
+	select {
+	case result := <-ch:
+		return result.reply, result.err
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+		return pluginReply{}, fmt.Errorf("no reply within %v", c.spec.Timeout)
+	}
+}
+
+func (c *pluginClient) connectLocked() error {
+	if c.closed {
+		return fmt.Errorf("plugin stopped")
+	}
+	if wait := time.Until(c.retryAt); wait > 0 {
+		return fmt.Errorf("plugin unavailable, retrying in %v", wait.Round(time.Second))
+	}
+
+	var (
+		conn    pluginConn
+		replies io.Reader
+	)
+	if c.spec.Socket != "" {
+		sock, err := net.DialTimeout("unix", c.spec.Socket, c.spec.Timeout)
+		if err != nil {
+			c.retryAt = time.Now().Add(pluginRetryDelay)
+			return err
+		}
+		conn, replies = sock, sock
+	} else {
+		cmd, stdin, stdout, err := startPluginProcess(c.name, c.spec.Command)
+		if err != nil {
+			c.retryAt = time.Now().Add(pluginRetryDelay)
+			return err
+		}
+		c.cmd = cmd
+		conn, replies = stdin, stdout
+	}
+
+	log.Printf("[PLUGIN] %s connected (%s)", c.name, c.spec.target())
+	c.conn = conn
+	c.enc = json.NewEncoder(conn)
+	c.pending = make(map[uint64]chan pluginResult)
+	go c.readReplies(conn, replies)
+	return nil
+}
+
+func (c *pluginClient) readReplies(conn pluginConn, r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var reply pluginReply
+		if err := dec.Decode(&reply); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("plugin closed the connection")
+			}
+			c.mu.Lock()
+			c.disconnectLocked(conn, err)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[reply.ID]
+		delete(c.pending, reply.ID)
+		c.mu.Unlock()
+		if ok {
+			ch <- pluginResult{reply: reply}
+		}
+	}
+}
+
+// disconnectLocked drops a broken connection and fails every call still
+// waiting on it.
+func (c *pluginClient) disconnectLocked(conn pluginConn, err error) {
+	if c.conn != conn {
+		return
+	}
+	if !c.closed {
+		log.Printf("[PLUGIN] %s disconnected: %v", c.name, err)
+	}
+	conn.Close()
+	if c.cmd != nil {
+		stopPluginProcess(c.cmd)
+		c.cmd = nil
+	}
+	for id, ch := range c.pending {
+		ch <- pluginResult{err: err}
+		delete(c.pending, id)
+	}
+	c.conn, c.enc = nil, nil
+	c.retryAt = time.Now().Add(pluginRetryDelay)
+}
+
+func (c *pluginClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.disconnectLocked(c.conn, fmt.Errorf("plugin stopped"))
+	}
+}
+
+// startPluginProcess runs a plugin with its stdin and stdout as the
+// message channel. Its stderr goes to the proxy log.
+func startPluginProcess(name string, command []string) (*exec.Cmd, *os.File, io.Reader, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = stdinR
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, nil, nil, err
+	}
+	stdinR.Close()
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[PLUGIN] %s: %s", name, scanner.Text())
+		}
+	}()
+	return cmd, stdinW, stdout, nil
+}
+
+// stopPluginProcess gives a plugin a moment to exit after its stdin is
+// closed, then kills it.
+func stopPluginProcess(cmd *exec.Cmd) {
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			cmd.Process.Kill()
+		}
+	}()
+}
+
+var (
+	pluginsMu      sync.Mutex
+	runningPlugins = make(map[string]*pluginClient)
+)
+
+// retainPlugins hands connections from the previous pipeline to plugins
+// that are still configured with the same target, and stops the rest.
+func retainPlugins(p *pipeline) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	next := make(map[string]*pluginClient)
+	for _, module := range p.modules {
+		plugin, ok := module.ExchangeModule.(*PluginModule)
+		if !ok {
+			continue
+		}
+		key := plugin.name + "\x00" + plugin.spec.target()
+		if client, ok := runningPlugins[key]; ok {
+			client.mu.Lock()
+			client.spec = plugin.spec
+			client.mu.Unlock()
+			plugin.client = client
+			delete(runningPlugins, key)
+		}
+		next[key] = plugin.client
+	}
+	for _, client := range runningPlugins {
+		client.Close()
+	}
+	runningPlugins = next
+}
+
+// ============================================================================
+// SCRIPT HOOKS
+// ============================================================================
+
+// A script module runs a hook file written in a small line-based language.
+// Embedding JavaScript or Starlark would need a third-party interpreter, so
+// the hooks cover the common one-off rewrites instead:
+//
+//	on request
+//	  if host ends "example.com" and not has header X-Debug
+//	    set header X-Debug "1"
+//	    log "tagged " + url
+//	  end
+//	end
+//
+// The file is re-read when it changes. A file that fails to parse keeps
+// the previous version running; the error shows in the monitor.
+const scriptCheckInterval = time.Second
+
+var hookFields = []string{"method", "url", "host", "path", "query", "header", "status", "body"}
+
+// hookRef names a part of the exchange. header and body refer to the
+// message of the hook's phase; the rest always refer to the request,
+// except status.
+type hookRef struct {
+	field string
+	name  string
+}
+
+type hookAtom struct {
+	lit string
+	ref *hookRef
+}
+
+// hookExpr is a concatenation: atom + atom + ...
+type hookExpr []hookAtom
+
+type hookTerm struct {
+	not   bool
+	has   *hookRef
+	ref   hookRef
+	op    string
+	value hookExpr
+	re    *regexp.Regexp
+}
+
+// hookCond is an OR of AND groups; "and" binds tighter than "or".
+type hookCond [][]hookTerm
+
+type hookStmt struct {
+	line int
+	kind string
+
+	cond       hookCond
+	then, els  []*hookStmt
+	ref        hookRef
+	args       []hookExpr
+	statusCode int
+}
+
+type hookProgram struct {
+	request  []*hookStmt
+	response []*hookStmt
+}
+
+type hookToken struct {
+	text string
+	str  bool
+}
+
+func (t hookToken) is(word string) bool { return !t.str && t.text == word }
+
+type hookLine struct {
+	num    int
+	tokens []hookToken
+}
+
+func tokenizeHookLine(line string) ([]hookToken, error) {
+	var tokens []hookToken
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '#':
+			return tokens, nil
+		case c == '"':
+			j := i + 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(line[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", line[i:j+1])
+			}
+			tokens = append(tokens, hookToken{text: s, str: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+				j++
+			}
+			tokens = append(tokens, hookToken{text: line[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type hookParser struct {
+	file  string
+	lines []hookLine
+	pos   int
+	phase string
+}
+
+func (p *hookParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.file, line, fmt.Sprintf(format, args...))
+}
+
+func parseHookScript(file, src string) (*hookProgram, error) {
+	p := &hookParser{file: file}
+	for i, text := range strings.Split(src, "\n") {
+		tokens, err := tokenizeHookLine(text)
+		if err != nil {
+			return nil, p.errorf(i+1, "%v", err)
+		}
+		if len(tokens) > 0 {
+			p.lines = append(p.lines, hookLine{num: i + 1, tokens: tokens})
+		}
+	}
+
+	prog := &hookProgram{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		p.pos++
+		if len(line.tokens) != 2 || !line.tokens[0].is("on") || (!line.tokens[1].is("request") && !line.tokens[1].is("response")) {
+			return nil, p.errorf(line.num, "expected \"on request\" or \"on response\"")
+		}
+		p.phase = line.tokens[1].text
+		body, _, err := p.parseBlock(line.num, "end")
+		if err != nil {
+			return nil, err
+		}
+		if p.phase == "request" {
+			prog.request = append(prog.request, body...)
+		} else {
+			prog.response = append(prog.response, body...)
+		}
+	}
+	return prog, nil
+}
+
+// parseBlock reads statements up to one of the terminator keywords and
+// returns the keyword that ended the block.
+func (p *hookParser) parseBlock(start int, terminators ...string) ([]*hookStmt, string, error) {
+	var stmts []*hookStmt
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		p.pos++
+		first := line.tokens[0]
+		for _, t := range terminators {
+			if first.is(t) {
+				if len(line.tokens) > 1 {
+					return nil, "", p.errorf(line.num, "unexpected %q after %s", line.tokens[1].text, t)
+				}
+				return stmts, t, nil
+			}
+		}
+		stmt, err := p.parseStmt(line)
+		if err != nil {
+			return nil, "", err
+		}
+		stmts = append(stmts, stmt)
+	}
+	return nil, "", p.errorf(start, "block is missing \"end\"")
+}
+
+func (p *hookParser) parseStmt(line hookLine) (*hookStmt, error) {
+	tokens := line.tokens
+	stmt := &hookStmt{line: line.num, kind: tokens[0].text}
+	if tokens[0].str {
+		return nil, p.errorf(line.num, "expected a command, got string %q", tokens[0].text)
+	}
+	args := tokens[1:]
+
+	switch stmt.kind {
+	case "if":
+		cond, err := p.parseCond(line.num, args)
+		if err != nil {
+			return nil, err
+		}
+		stmt.cond = cond
+		var end string
+		if stmt.then, end, err = p.parseBlock(line.num, "else", "end"); err != nil {
+			return nil, err
+		}
+		if end == "else" {
+			if stmt.els, _, err = p.parseBlock(line.num, "end"); err != nil {
+				return nil, err
+			}
+		}
+	case "set":
+		ref, n, err := p.parseRef(line.num, args, true)
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.parseExpr(line.num, args[n:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.ref, stmt.args = ref, []hookExpr{value}
+	case "remove":
+		ref, n, err := p.parseRef(line.num, args, true)
+		if err != nil {
+			return nil, err
+		}
+		if (ref.field != "header" && ref.field != "query") || n != len(args) {
+			return nil, p.errorf(line.num, "usage: remove header NAME | remove query NAME")
+		}
+		stmt.ref = ref
+	case "replace":
+		ref, n, err := p.parseRef(line.num, args, true)
+		if err != nil {
+			return nil, err
+		}
+		rest := args[n:]
+		with := slices.IndexFunc(rest, func(t hookToken) bool { return t.is("with") })
+		if with < 0 {
+			return nil, p.errorf(line.num, "usage: replace FIELD OLD with NEW")
+		}
+		old, err := p.parseExpr(line.num, rest[:with])
+		if err != nil {
+			return nil, err
+		}
+		repl, err := p.parseExpr(line.num, rest[with+1:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.ref, stmt.args = ref, []hookExpr{old, repl}
+	case "log":
+		value, err := p.parseExpr(line.num, args)
+		if err != nil {
+			return nil, err
+		}
+		stmt.args = []hookExpr{value}
+	case "respond":
+		if p.phase != "request" {
+			return nil, p.errorf(line.num, "respond is only allowed in request hooks")
+		}
+		if len(args) == 0 {
+			return nil, p.errorf(line.num, "usage: respond STATUS [BODY]")
+		}
+		code, err := strconv.Atoi(args[0].text)
+		if err != nil || code < 100 || code > 999 {
+			return nil, p.errorf(line.num, "%q is not an HTTP status", args[0].text)
+		}
+		stmt.statusCode = code
+		if len(args) > 1 {
+			body, err := p.parseExpr(line.num, args[1:])
+			if err != nil {
+				return nil, err
+			}
+			stmt.args = []hookExpr{body}
+		}
+	case "drop", "abort", "stop":
+		if len(args) > 0 {
+			return nil, p.errorf(line.num, "%s takes no arguments", stmt.kind)
+		}
+	default:
+		return nil, p.errorf(line.num, "unknown command %q", stmt.kind)
+	}
+	return stmt, nil
+}
+
+// parseRef reads a field reference (one token, or two for header and
+// query) and checks that it can be used in the current phase.
+func (p *hookParser) parseRef(line int, tokens []hookToken, write bool) (hookRef, int, error) {
+	if len(tokens) == 0 || tokens[0].str || !slices.Contains(hookFields, tokens[0].text) {
+		return hookRef{}, 0, p.errorf(line, "expected one of %s", strings.Join(hookFields, ", "))
+	}
+	ref := hookRef{field: tokens[0].text}
+	n := 1
+	if ref.field == "header" || ref.field == "query" {
+		if len(tokens) < 2 {
+			return hookRef{}, 0, p.errorf(line, "%s needs a name", ref.field)
+		}
+		ref.name = tokens[1].text
+		n = 2
+	}
+	switch {
+	case ref.field == "status" && p.phase != "response":
+		return hookRef{}, 0, p.errorf(line, "status is only available in response hooks")
+	case write && p.phase == "response" && ref.field != "header" && ref.field != "body" && ref.field != "status":
+		return hookRef{}, 0, p.errorf(line, "%s can only be changed in request hooks", ref.field)
+	}
+	return ref, n, nil
+}
+
+func (p *hookParser) parseExpr(line int, tokens []hookToken) (hookExpr, error) {
+	if len(tokens) == 0 {
+		return nil, p.errorf(line, "missing value")
+	}
+	var expr hookExpr
+	for i := 0; i < len(tokens); {
+		if i > 0 {
+			if !tokens[i].is("+") {
+				return nil, p.errorf(line, "expected + before %q", tokens[i].text)
+			}
+			i++
+			if i == len(tokens) {
+				return nil, p.errorf(line, "missing value after +")
+			}
+		}
+		t := tokens[i]
+		if t.str {
+			expr = append(expr, hookAtom{lit: t.text})
+			i++
+			continue
+		}
+		if _, err := strconv.Atoi(t.text); err == nil {
+			expr = append(expr, hookAtom{lit: t.text})
+			i++
+			continue
+		}
+		ref, n, err := p.parseRef(line, tokens[i:], false)
+		if err != nil {
+			return nil, err
+		}
+		expr = append(expr, hookAtom{ref: &ref})
+		i += n
+	}
+	return expr, nil
+}
+
+var hookOps = []string{"==", "!=", "contains", "starts", "ends", "matches"}
+
+func (p *hookParser) parseCond(line int, tokens []hookToken) (hookCond, error) {
+	var cond hookCond
+	var group []hookTerm
+	start := 0
+	for i := 0; i <= len(tokens); i++ {
+		if i < len(tokens) && !tokens[i].is("and") && !tokens[i].is("or") {
+			continue
+		}
+		term, err := p.parseTerm(line, tokens[start:i])
+		if err != nil {
+			return nil, err
+		}
+		group = append(group, term)
+		if i == len(tokens) || tokens[i].is("or") {
+			cond = append(cond, group)
+			group = nil
+		}
+		start = i + 1
+	}
+	return cond, nil
+}
+
+func (p *hookParser) parseTerm(line int, tokens []hookToken) (hookTerm, error) {
+	var term hookTerm
+	if len(tokens) > 0 && tokens[0].is("not") {
+		term.not = true
+		tokens = tokens[1:]
+	}
+	if len(tokens) > 0 && tokens[0].is("has") {
+		ref, n, err := p.parseRef(line, tokens[1:], false)
+		if err != nil {
+			return term, err
+		}
+		if (ref.field != "header" && ref.field != "query") || n+1 != len(tokens) {
+			return term, p.errorf(line, "usage: has header NAME | has query NAME")
+		}
+		term.has = &ref
+		return term, nil
+	}
+
+	ref, n, err := p.parseRef(line, tokens, false)
+	if err != nil {
+		return term, err
+	}
+	if n >= len(tokens) || tokens[n].str || !slices.Contains(hookOps, tokens[n].text) {
+		return term, p.errorf(line, "expected a comparison (%s)", strings.Join(hookOps, ", "))
+	}
+	term.ref, term.op = ref, tokens[n].text
+	if term.value, err = p.parseExpr(line, tokens[n+1:]); err != nil {
+		return term, err
+	}
+	if term.op == "matches" {
+		if len(term.value) != 1 || term.value[0].ref != nil {
+			return term, p.errorf(line, "matches needs a single quoted pattern")
+		}
+		if term.re, err = regexp.Compile(term.value[0].lit); err != nil {
+			return term, p.errorf(line, "bad pattern: %v", err)
+		}
+	}
+	return term, nil
+}
+
+// hookRun is one hook invocation.
+type hookRun struct {
+	module *ScriptModule
+	x      *Exchange
+	phase  string
+}
+
+// errHookStop ends a hook early without an error.
+var errHookStop = errors.New("stop")
+
+// hookError is a runtime error at a script line.
+type hookError struct {
+	file string
+	line int
+	err  error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.file, e.line, e.err)
+}
+
+func (r *hookRun) exec(stmts []*hookStmt) error {
+	for _, stmt := range stmts {
+		if err := r.stmt(stmt); err != nil {
+			var herr *hookError
+			if err == errHookStop || isExchangeStop(err) || errors.As(err, &herr) {
+				return err
+			}
+			return &hookError{file: r.module.path, line: stmt.line, err: err}
+		}
+	}
+	return nil
+}
+
+func (r *hookRun) stmt(stmt *hookStmt) error {
+	switch stmt.kind {
+	case "if":
+		ok, err := r.cond(stmt.cond)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return r.exec(stmt.then)
+		}
+		return r.exec(stmt.els)
+	case "set":
+		value, err := r.eval(stmt.args[0])
+		if err != nil {
+			return err
+		}
+		return r.set(stmt.ref, value)
+	case "remove":
+		if stmt.ref.field == "query" {
+			q := r.x.Request.URL.Query()
+			q.Del(stmt.ref.name)
+			r.x.Request.URL.RawQuery = q.Encode()
+			return nil
+		}
+		r.header().Del(stmt.ref.name)
+		return nil
+	case "replace":
+		old, err := r.eval(stmt.args[0])
+		if err != nil {
+			return err
+		}
+		repl, err := r.eval(stmt.args[1])
+		if err != nil {
+			return err
+		}
+		current, err := r.get(stmt.ref)
+		if err != nil {
+			return err
+		}
+		return r.set(stmt.ref, strings.ReplaceAll(current, old, repl))
+	case "log":
+		msg, err := r.eval(stmt.args[0])
+		if err != nil {
+			return err
+		}
+		log.Printf("[SCRIPT] %s: %s", r.module.name, msg)
+		return nil
+	case "respond":
+		body := ""
+		if len(stmt.args) > 0 {
+			var err error
+			if body, err = r.eval(stmt.args[0]); err != nil {
+				return err
+			}
+		}
+		r.x.Respond(stmt.statusCode, nil, body)
+		return errHookStop
+	case "drop":
+		return ErrDropExchange
+	case "abort":
+		return ErrAbortExchange
+	case "stop":
+		return errHookStop
+	}
+	return fmt.Errorf("unknown command %q", stmt.kind)
+}
+
+func (r *hookRun) cond(cond hookCond) (bool, error) {
+	for _, group := range cond {
+		all := true
+		for _, term := range group {
+			ok, err := r.term(term)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *hookRun) term(term hookTerm) (bool, error) {
+	var ok bool
+	if term.has != nil {
+		if term.has.field == "query" {
+			ok = r.x.Request.URL.Query().Has(term.has.name)
+		} else {
+			ok = len(r.header().Values(term.has.name)) > 0
+		}
+		return ok != term.not, nil
+	}
+
+	left, err := r.get(term.ref)
+	if err != nil {
+		return false, err
+	}
+	right, err := r.eval(term.value)
+	if err != nil {
+		return false, err
+	}
+	switch term.op {
+	case "==":
+		ok = left == right
+	case "!=":
+		ok = left != right
+	case "contains":
+		ok = strings.Contains(left, right)
+	case "starts":
+		ok = strings.HasPrefix(left, right)
+	case "ends":
+		ok = strings.HasSuffix(left, right)
+	case "matches":
+		ok = term.re.MatchString(left)
+	}
+	return ok != term.not, nil
+}
+
+func (r *hookRun) eval(expr hookExpr) (string, error) {
+	var b strings.Builder
+	for _, atom := range expr {
+		if atom.ref == nil {
+			b.WriteString(atom.lit)
+			continue
+		}
+		value, err := r.get(*atom.ref)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+func (r *hookRun) header() http.Header {
+	if r.phase == "response" {
+		return r.x.Response.Header
+	}
+	return r.x.Request.Header
+}
+
+func (r *hookRun) get(ref hookRef) (string, error) {
+	req := r.x.Request
+	switch ref.field {
+	case "method":
+		return req.Method, nil
+	case "url":
+		return req.URL.String(), nil
+	case "host":
+		return req.URL.Host, nil
+	case "path":
+		return req.URL.Path, nil
+	case "query":
+		return req.URL.Query().Get(ref.name), nil
+	case "header":
+		return r.header().Get(ref.name), nil
+	case "status":
+		return strconv.Itoa(r.x.Response.StatusCode), nil
+	case "body":
+		if r.phase == "response" {
+			body, err := readAndRestoreResponseBody(r.x.Response)
+			return string(body), err
+		}
+		if req.Body == nil || req.Body == http.NoBody {
+			return "", nil
+		}
+		body, err := readAndRestoreRequestBody(req)
+		return string(body), err
+	}
+	return "", fmt.Errorf("unknown field %q", ref.field)
+}
+
+func (r *hookRun) set(ref hookRef, value string) error {
+	req := r.x.Request
+	switch ref.field {
+	case "method":
+		req.Method = strings.ToUpper(value)
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("%q is not an absolute URL", value)
+		}
+		req.URL, req.Host = u, u.Host
+	case "host":
+		req.URL.Host, req.Host = value, value
+	case "path":
+		req.URL.Path, req.URL.RawPath = value, ""
+	case "query":
+		q := req.URL.Query()
+		q.Set(ref.name, value)
+		req.URL.RawQuery = q.Encode()
+	case "header":
+		r.header().Set(ref.name, value)
+	case "status":
+		code, err := strconv.Atoi(value)
+		if err != nil || code < 100 || code > 999 {
+			return fmt.Errorf("%q is not an HTTP status", value)
+		}
+		r.x.Response.StatusCode = code
+		r.x.Response.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+	case "body":
+		if r.phase == "response" {
+			applyPluginResponse(r.x.Response, &pluginHTTP{Body: []byte(value)})
+		} else {
+			applyPluginRequest(req, &pluginHTTP{Body: []byte(value)})
+		}
+	default:
+		return fmt.Errorf("unknown field %q", ref.field)
+	}
+	return nil
+}
+
+// readAndRestoreResponseBody reads the whole response body and puts an
+// equivalent reader back.
+func readAndRestoreResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// ScriptStatus is what the monitor shows for a script module.
+type ScriptStatus struct {
+	Name       string    `json:"name"`
+	File       string    `json:"file"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	LoadError  string    `json:"load_error,omitempty"`
+	RunError   string    `json:"run_error,omitempty"`
+	RunErrorAt time.Time `json:"run_error_at"`
+	RunErrors  int       `json:"run_errors"`
+}
+
+// ScriptModule runs a hook file, re-reading it when it changes.
+type ScriptModule struct {
+	name string
+	path string
+
+	mu      sync.Mutex
+	prog    *hookProgram
+	stamp   string
+	checked time.Time
+	status  ScriptStatus
+}
+
+func newScriptModule(p *moduleParams) (configuredModule, error) {
+	file, ok := p.last("file")
+	if !ok {
+		return configuredModule{}, p.missing("file")
+	}
+	m := &ScriptModule{name: p.config.Name, path: file.Value}
+	m.status = ScriptStatus{Name: m.name, File: m.path}
+	if err := m.load(); err != nil {
+		return configuredModule{}, p.errorf(file.Source, "%v", err)
+	}
+	return configuredModule{module: m}, nil
+}
+
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+// load parses the file; on failure the previous program stays in place.
+// The caller holds m.mu, except during construction.
+func (m *ScriptModule) load() error {
+	m.stamp = fileStamp(m.path)
+	src, err := os.ReadFile(m.path)
+	if err == nil {
+		var prog *hookProgram
+		if prog, err = parseHookScript(m.path, string(src)); err == nil {
+			m.prog = prog
+			m.status.LoadedAt = time.Now()
+			m.status.LoadError = ""
+			return nil
+		}
+	}
+	m.status.LoadError = err.Error()
+	return err
+}
+
+func (m *ScriptModule) program() *hookProgram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.checked) >= scriptCheckInterval {
+		m.checked = time.Now()
+		if stamp := fileStamp(m.path); stamp != m.stamp {
+			if err := m.load(); err != nil {
+				log.Printf("[SCRIPT] %s: keeping the previous version: %v", m.name, err)
+			} else {
+				log.Printf("[SCRIPT] %s: reloaded %s", m.name, m.path)
+			}
+		}
+	}
+	return m.prog
+}
+
+func (m *ScriptModule) Status() ScriptStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *ScriptModule) Name() string {
+	return fmt.Sprintf("Script(%s)", m.name)
+}
+
+func (m *ScriptModule) HandleRequest(x *Exchange) error {
+	return m.run(x, "request", m.program().request)
+}
+
+func (m *ScriptModule) HandleResponse(x *Exchange) error {
+	return m.run(x, "response", m.program().response)
+}
+
+func (m *ScriptModule) run(x *Exchange, phase string, stmts []*hookStmt) error {
+	if len(stmts) == 0 {
+		return nil
+	}
+	err := (&hookRun{module: m, x: x, phase: phase}).exec(stmts)
+	if err == errHookStop {
+		return nil
+	}
+	if err == nil || isExchangeStop(err) {
+		return err
+	}
+	m.mu.Lock()
+	m.status.RunError = err.Error()
+	m.status.RunErrorAt = time.Now()
+	m.status.RunErrors++
+	m.mu.Unlock()
+	return err
+}
+
+// handleAPIScripts lists the script modules with their load and run errors.
+func handleAPIScripts(w http.ResponseWriter, r *http.Request) {
+	statuses := []ScriptStatus{}
+	for _, module := range currentPipeline().modules {
+		if script, ok := module.ExchangeModule.(*ScriptModule); ok {
+			statuses = append(statuses, script.Status())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// ============================================================================
+// MATCH AND REPLACE
+// ============================================================================
+
+// ruleScope limits a rule to some hosts (host patterns as in [ct_hosts]),
+// a path regular expression and content types (substrings of
+// Content-Type).
+type ruleScope struct {
+	hosts        []string
+	path         *regexp.Regexp
+	contentTypes []string
+}
+
+func (p *moduleParams) ruleScope() (ruleScope, error) {
+	s, err := p.requestScope()
+	s.contentTypes = p.list("content_types")
+	return s, err
+}
+
+// requestScope parses only hosts and path, for modules that act before a
+// response exists; content_types is then reported as an unknown key.
+func (p *moduleParams) requestScope() (ruleScope, error) {
+	s := ruleScope{hosts: p.list("hosts")}
+	if param, ok := p.last("path"); ok {
+		re, err := regexp.Compile(param.Value)
+		if err != nil {
+			return s, p.errorf(param.Source, "path: %v", err)
+		}
+		s.path = re
+	}
+	return s, nil
+}
+
+func (s ruleScope) matchesRequest(req *http.Request) bool {
+	if len(s.hosts) > 0 && !slices.ContainsFunc(s.hosts, func(h string) bool { return matchHostPattern(h, req.URL.Hostname()) }) {
+		return false
+	}
+	return s.path == nil || s.path.MatchString(req.URL.Path)
+}
+
+func (s ruleScope) matchesContentType(contentType string) bool {
+	if len(s.contentTypes) == 0 {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	for _, want := range s.contentTypes {
+		if strings.Contains(contentType, strings.ToLower(want)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleStats is a rule's hit count as shown in the monitor.
+type RuleStats struct {
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Description  string    `json:"description"`
+	Hits         int64     `json:"hits"`
+	Replacements int64     `json:"replacements,omitempty"`
+	Skipped      int64     `json:"skipped,omitempty"`
+	LastHit      time.Time `json:"last_hit"`
+}
+
+// ruleCounters are kept by rule modules and reset when the configuration
+// is reloaded.
+type ruleCounters struct {
+	hits         atomic.Int64
+	replacements atomic.Int64
+	skipped      atomic.Int64
+	lastHit      atomic.Int64
+}
+
+func (c *ruleCounters) hit(replacements int) {
+	c.hits.Add(1)
+	c.replacements.Add(int64(replacements))
+	c.lastHit.Store(time.Now().UnixNano())
+}
+
+func (c *ruleCounters) stats(name, typ, description string) RuleStats {
+	s := RuleStats{
+		Name:         name,
+		Type:         typ,
+		Description:  description,
+		Hits:         c.hits.Load(),
+		Replacements: c.replacements.Load(),
+		Skipped:      c.skipped.Load(),
+	}
+	if last := c.lastHit.Load(); last != 0 {
+		s.LastHit = time.Unix(0, last)
+	}
+	return s
+}
+
+// ruleModule is implemented by modules that report hits at /api/rules.
+type ruleModule interface {
+	RuleStats() RuleStats
+}
+
+func handleAPIRules(w http.ResponseWriter, r *http.Request) {
+	rules := []RuleStats{}
+	for _, module := range currentPipeline().modules {
+		if rule, ok := module.ExchangeModule.(ruleModule); ok {
+			rules = append(rules, rule.RuleStats())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+var rewriteTargets = []string{"request_line", "url", "header", "cookie", "body"}
+
+// RewriteModule is one match-and-replace rule. The replacement may refer
+// to capture groups as $1 or ${name}.
+type RewriteModule struct {
+	name     string
+	scope    ruleScope
+	request  bool
+	response bool
+	target   string
+	field    string
+	match    *regexp.Regexp
+	replace  string
+	counters ruleCounters
+}
+
+func newRewriteModule(p *moduleParams) (configuredModule, error) {
+	m := &RewriteModule{name: p.config.Name}
+	var err error
+	if m.scope, err = p.ruleScope(); err != nil {
+		return configuredModule{}, err
+	}
+
+	target, ok := p.last("target")
+	if !ok {
+		return configuredModule{}, p.missing("target")
+	}
+	if m.target = strings.ToLower(target.Value); !slices.Contains(rewriteTargets, m.target) {
+		return configuredModule{}, p.errorf(target.Source, "target: %q is not one of %s", target.Value, strings.Join(rewriteTargets, ", "))
+	}
+	if name, ok := p.last("name"); ok {
+		if m.target != "header" && m.target != "cookie" {
+			return configuredModule{}, p.errorf(name.Source, "name only applies to header and cookie targets")
+		}
+		m.field = name.Value
+	}
+
+	match, ok := p.last("match")
+	if !ok {
+		return configuredModule{}, p.missing("match")
+	}
+	if m.match, err = regexp.Compile(match.Value); err != nil {
+		return configuredModule{}, p.errorf(match.Source, "match: %v", err)
+	}
+	if replace, ok := p.last("replace"); ok {
+		m.replace = replace.Value
+	}
+
+	m.request, m.response = true, true
+	if m.target == "request_line" || m.target == "url" {
+		m.response = false
+	}
+	if direction, ok := p.last("direction"); ok {
+		switch strings.ToLower(direction.Value) {
+		case "request":
+			m.response = false
+		case "response":
+			m.request = false
+		case "both":
+		default:
+			return configuredModule{}, p.errorf(direction.Source, "direction: %q is not one of request, response, both", direction.Value)
+		}
+		if m.response && !m.request && (m.target == "request_line" || m.target == "url") {
+			return configuredModule{}, p.errorf(direction.Source, "%s can only be rewritten in requests", m.target)
+		}
+	}
+	return configuredModule{module: m}, nil
+}
+
+func (m *RewriteModule) Name() string {
+	return fmt.Sprintf("Rewrite(%s)", m.name)
+}
+
+func (m *RewriteModule) RuleStats() RuleStats {
+	direction := "both"
+	switch {
+	case !m.response:
+		direction = "request"
+	case !m.request:
+		direction = "response"
+	}
+	target := m.target
+	if m.field != "" {
+		target += " " + m.field
+	}
+	return m.counters.stats(m.name, "rewrite", fmt.Sprintf("%s %s: %s -> %s", direction, target, m.match, m.replace))
+}
+
+func (m *RewriteModule) HandleRequest(x *Exchange) error {
+	req := x.Request
+	if !m.scope.matchesRequest(req) {
+		return nil
+	}
+	if m.response && m.target == "body" {
+		// Only gzip and deflate can be decoded, so don't let the server
+		// pick brotli or zstd. Without the header the Transport asks for
+		// gzip and decodes it itself.
+		if accept := req.Header.Get("Accept-Encoding"); accept != "" {
+			req.Header.Set("Accept-Encoding", decodableAcceptEncoding(accept))
+		}
+	}
+	if !m.request {
+		return nil
+	}
+
+	var n int
+	var err error
+	switch m.target {
+	case "request_line":
+		line, count := m.apply(req.Method + " " + req.URL.String())
+		if count > 0 {
+			method, rawURL, _ := strings.Cut(line, " ")
+			err = setRequestURL(req, rawURL)
+			req.Method = method
+		}
+		n = count
+	case "url":
+		rawURL, count := m.apply(req.URL.String())
+		if count > 0 {
+			err = setRequestURL(req, rawURL)
+		}
+		n = count
+	case "header":
+		n = m.rewriteHeaders(req.Header)
+	case "cookie":
+		n = m.rewriteCookies(req.Header, "Cookie")
+	case "body":
+		if m.scope.matchesContentType(req.Header.Get("Content-Type")) {
+			n, err = m.rewriteRequestBody(req)
+		}
+	}
+	if n > 0 {
+		m.counters.hit(n)
+	}
+	return err
+}
+
+func (m *RewriteModule) HandleResponse(x *Exchange) error {
+	resp := x.Response
+	if !m.response || !m.scope.matchesRequest(x.Request) {
+		return nil
+	}
+
+	var n int
+	var err error
+	switch m.target {
+	case "header":
+		n = m.rewriteHeaders(resp.Header)
+	case "cookie":
+		n = m.rewriteCookies(resp.Header, "Set-Cookie")
+	case "body":
+		if m.scope.matchesContentType(resp.Header.Get("Content-Type")) {
+			n, err = m.rewriteResponseBody(resp)
+		}
+	}
+	if n > 0 {
+		m.counters.hit(n)
+	}
+	return err
+}
+
+// apply replaces every match, expanding capture groups, and returns the
+// result with the number of matches.
+func (m *RewriteModule) apply(s string) (string, int) {
+	matches := m.match.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, 0
+	}
+	var out []byte
+	last := 0
+	for _, loc := range matches {
+		out = append(out, s[last:loc[0]]...)
+		out = m.match.ExpandString(out, m.replace, s, loc)
+		last = loc[1]
+	}
+	return string(append(out, s[last:]...)), len(matches)
+}
+
+func setRequestURL(req *http.Request, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("rewritten URL %q is not absolute", rawURL)
+	}
+	req.URL, req.Host = u, u.Host
+	return nil
+}
+
+// rewriteHeaders matches "Name: value" lines, or only the values of the
+// named header. A line rewritten to nothing removes the header.
+func (m *RewriteModule) rewriteHeaders(h http.Header) int {
+	total := 0
+	if m.field != "" {
+		values := h.Values(m.field)
+		var kept []string
+		for _, value := range values {
+			value, n := m.apply(value)
+			total += n
+			if value != "" {
+				kept = append(kept, value)
+			}
+		}
+		if total > 0 {
+			h.Del(m.field)
+			for _, value := range kept {
+				h.Add(m.field, value)
+			}
+		}
+		return total
+	}
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rewritten := make(http.Header)
+	for _, name := range names {
+		for _, value := range h[name] {
+			line, n := m.apply(name + ": " + value)
+			total += n
+			newName, newValue, ok := strings.Cut(line, ":")
+			if newName = strings.TrimSpace(newName); ok && newName != "" {
+				rewritten.Add(newName, strings.TrimSpace(newValue))
+			}
+		}
+	}
+	if total > 0 {
+		for name := range h {
+			delete(h, name)
+		}
+		for name, values := range rewritten {
+			h[name] = values
+		}
+	}
+	return total
+}
+
+// rewriteCookies matches "name=value" pairs of the Cookie header, or whole
+// Set-Cookie lines. With a name, only that cookie's value is matched.
+func (m *RewriteModule) rewriteCookies(h http.Header, header string) int {
+	total := 0
+	var lines []string
+	for _, line := range h.Values(header) {
+		var parts []string
+		if header == "Cookie" {
+			parts = strings.Split(line, ";")
+		} else {
+			parts = []string{line}
+		}
+
+		var kept []string
+		for _, part := range parts {
+			part = strings.TrimSpace(part)
+			if m.field == "" {
+				part, n := m.apply(part)
+				total += n
+				if part != "" {
+					kept = append(kept, part)
+				}
+				continue
+			}
+			name, rest, _ := strings.Cut(part, "=")
+			if strings.TrimSpace(name) != m.field {
+				kept = append(kept, part)
+				continue
+			}
+			value, attrs, hasAttrs := strings.Cut(rest, ";")
+			value, n := m.apply(value)
+			total += n
+			if hasAttrs {
+				value += ";" + attrs
+			}
+			kept = append(kept, name+"="+value)
+		}
+		if len(kept) > 0 {
+			lines = append(lines, strings.Join(kept, "; "))
+		}
+	}
+	if total > 0 {
+		h.Del(header)
+		for _, line := range lines {
+			h.Add(header, line)
+		}
+	}
+	return total
+}
+
+func (m *RewriteModule) rewriteRequestBody(req *http.Request) (int, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return 0, nil
+	}
+	raw, err := readAndRestoreRequestBody(req)
+	if err != nil {
+		return 0, err
+	}
+	body, n, err := m.rewriteBody(raw, req.Header.Get("Content-Encoding"))
+	if n > 0 && err == nil {
+		applyPluginRequest(req, &pluginHTTP{Body: body})
+	}
+	return n, err
+}
+
+func (m *RewriteModule) rewriteResponseBody(resp *http.Response) (int, error) {
+	raw, err := readAndRestoreResponseBody(resp)
+	if err != nil || raw == nil {
+		return 0, err
+	}
+	body, n, err := m.rewriteBody(raw, resp.Header.Get("Content-Encoding"))
+	if n > 0 && err == nil {
+		applyPluginResponse(resp, &pluginHTTP{Body: body})
+	}
+	return n, err
+}
+
+// rewriteBody decodes, rewrites and re-encodes a body with its original
+// Content-Encoding. Bodies in other encodings are counted as skipped.
+func (m *RewriteModule) rewriteBody(raw []byte, encoding string) ([]byte, int, error) {
+	plain, err := decodeContent(raw, encoding)
+	if err != nil {
+		m.counters.skipped.Add(1)
+		return nil, 0, nil
+	}
+
+	matches := m.match.FindAllSubmatchIndex(plain, -1)
+	if len(matches) == 0 {
+		return nil, 0, nil
+	}
+	var out []byte
+	last := 0
+	for _, loc := range matches {
+		out = append(out, plain[last:loc[0]]...)
+		out = m.match.Expand(out, []byte(m.replace), plain, loc)
+		last = loc[1]
+	}
+	out = append(out, plain[last:]...)
+
+	encoded, err := encodeContent(out, encoding)
+	if err != nil {
+		return nil, 0, err
+	}
+	return encoded, len(matches), nil
+}
+
+func decodeContent(data []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case "deflate":
+		// "deflate" is zlib-wrapped, though some servers send raw deflate
+		if r, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			defer r.Close()
+			return io.ReadAll(r)
+		}
+		return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+func encodeContent(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodableAcceptEncoding keeps only the encodings decodeContent handles,
+// falling back to identity when none of them were offered.
+func decodableAcceptEncoding(accept string) string {
+	var kept []string
+	for _, part := range strings.Split(accept, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip", "deflate", "identity":
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	if len(kept) == 0 {
+		return "identity"
+	}
+	return strings.Join(kept, ", ")
+}
+
+// ============================================================================
+// MAP LOCAL AND MAP REMOTE
+// ============================================================================
+
+// MapLocalModule answers matching requests from a file, or from a
+// directory tree, instead of the upstream.
+type MapLocalModule struct {
+	name        string
+	scope       ruleScope
+	file        string
+	dir         string
+	stripPrefix string
+	passThrough bool
+	counters    ruleCounters
+}
+
+func newMapLocalModule(p *moduleParams) (configuredModule, error) {
+	m := &MapLocalModule{name: p.config.Name}
+	var err error
+	if m.scope, err = p.requestScope(); err != nil {
+		return configuredModule{}, err
+	}
+
+	file, hasFile := p.last("file")
+	dir, hasDir := p.last("dir")
+	switch {
+	case hasFile && hasDir:
+		return configuredModule{}, p.errorf(dir.Source, "file and dir are mutually exclusive")
+	case hasFile:
+		if info, err := os.Stat(file.Value); err != nil || info.IsDir() {
+			return configuredModule{}, p.errorf(file.Source, "file: %s is not a readable file", file.Value)
+		}
+		m.file = file.Value
+	case hasDir:
+		if info, err := os.Stat(dir.Value); err != nil || !info.IsDir() {
+			return configuredModule{}, p.errorf(dir.Source, "dir: %s is not a directory", dir.Value)
+		}
+		m.dir = dir.Value
+	default:
+		return configuredModule{}, p.missing("file or dir")
+	}
+
+	if prefix, ok := p.last("strip_prefix"); ok {
+		m.stripPrefix = prefix.Value
+	}
+	if m.passThrough, err = p.boolean("fallthrough", false); err != nil {
+		return configuredModule{}, err
+	}
+	return configuredModule{module: m}, nil
+}
+
+func (m *MapLocalModule) Name() string {
+	return fmt.Sprintf("MapLocal(%s)", m.name)
+}
+
+func (m *MapLocalModule) RuleStats() RuleStats {
+	target := m.file
+	if m.dir != "" {
+		target = m.dir + string(filepath.Separator)
+	}
+	return m.counters.stats(m.name, "map_local", fmt.Sprintf("%s -> %s", describeScope(m.scope), target))
+}
+
+// localPath maps the request path into the directory. Cleaning it as an
+// absolute path first keeps ".." from climbing out.
+func (m *MapLocalModule) localPath(req *http.Request) string {
+	if m.file != "" {
+		return m.file
+	}
+	rel := strings.TrimPrefix(req.URL.Path, m.stripPrefix)
+	path := filepath.Join(m.dir, filepath.Join(string(filepath.Separator), filepath.FromSlash(rel)))
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "index.html")
+	}
+	return path
+}
+
+func (m *MapLocalModule) HandleRequest(x *Exchange) error {
+	if !m.scope.matchesRequest(x.Request) {
+		return nil
+	}
+
+	path := m.localPath(x.Request)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if m.passThrough && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		status := http.StatusNotFound
+		if !errors.Is(err, os.ErrNotExist) {
+			status = http.StatusInternalServerError
+		}
+		x.Respond(status, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, fmt.Sprintf("map_local %s: %v\n", m.name, err))
+	} else {
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		x.Respond(http.StatusOK, http.Header{"Content-Type": {contentType}}, string(data))
+	}
+
+	x.MapType, x.MapTarget = "local", path
+	m.counters.hit(0)
+	return nil
+}
+
+func (m *MapLocalModule) HandleResponse(x *Exchange) error {
+	return nil
+}
+
+// MapRemoteModule sends matching requests to another backend.
+type MapRemoteModule struct {
+	name         string
+	scope        ruleScope
+	to           *url.URL
+	stripPrefix  string
+	preserveHost bool
+	counters     ruleCounters
+}
+
+func newMapRemoteModule(p *moduleParams) (configuredModule, error) {
+	m := &MapRemoteModule{name: p.config.Name}
+	var err error
+	if m.scope, err = p.requestScope(); err != nil {
+		return configuredModule{}, err
+	}
+
+	to, ok := p.last("to")
+	if !ok {
+		return configuredModule{}, p.missing("to")
+	}
+	if m.to, err = url.Parse(to.Value); err != nil || (m.to.Scheme != "http" && m.to.Scheme != "https") || m.to.Host == "" {
+		return configuredModule{}, p.errorf(to.Source, "to: %q is not an http(s)://host[:port][/path] URL", to.Value)
+	}
+	if prefix, ok := p.last("strip_prefix"); ok {
+		m.stripPrefix = prefix.Value
+	}
+	if m.preserveHost, err = p.boolean("preserve_host", false); err != nil {
+		return configuredModule{}, err
+	}
+	return configuredModule{module: m}, nil
+}
+
+func (m *MapRemoteModule) Name() string {
+	return fmt.Sprintf("MapRemote(%s)", m.name)
+}
+
+func (m *MapRemoteModule) RuleStats() RuleStats {
+	return m.counters.stats(m.name, "map_remote", fmt.Sprintf("%s -> %s", describeScope(m.scope), m.to))
+}
+
+func (m *MapRemoteModule) HandleRequest(x *Exchange) error {
+	req := x.Request
+	if !m.scope.matchesRequest(req) {
+		return nil
+	}
+
+	mapped := *req.URL
+	mapped.Scheme, mapped.Host = m.to.Scheme, m.to.Host
+	if m.to.Path != "" || m.stripPrefix != "" {
+		rest := strings.TrimPrefix(req.URL.Path, m.stripPrefix)
+		mapped.Path = strings.TrimSuffix(m.to.Path, "/") + "/" + strings.TrimPrefix(rest, "/")
+		mapped.RawPath = ""
+	}
+
+	req.URL = &mapped
+	if !m.preserveHost {
+		req.Host = mapped.Host
+	}
+	x.MapType, x.MapTarget = "remote", mapped.String()
+	m.counters.hit(0)
+	return nil
+}
+
+func (m *MapRemoteModule) HandleResponse(x *Exchange) error {
+	return nil
+}
+
+func describeScope(s ruleScope) string {
+	var parts []string
+	if len(s.hosts) > 0 {
+		parts = append(parts, strings.Join(s.hosts, ","))
+	}
+	if s.path != nil {
+		parts = append(parts, s.path.String())
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, " ")
+}
+
+// ============================================================================
+// MOCK RESPONSES
+// ============================================================================
+
+// MockRule is one stub in a mock file. Every match field is optional; path,
+// query values and body are regular expressions, host is a host pattern.
+type MockRule struct {
+	Name     string       `json:"name,omitempty"`
+	Disabled bool         `json:"disabled,omitempty"`
+	Match    MockMatch    `json:"match"`
+	Response MockResponse `json:"response"`
+}
+
+type MockMatch struct {
+	Method string            `json:"method,omitempty"`
+	Host   string            `json:"host,omitempty"`
+	Path   string            `json:"path,omitempty"`
+	Query  map[string]string `json:"query,omitempty"`
+	Body   string            `json:"body,omitempty"`
+}
+
+// MockResponse is what a matching request gets back. Body is a
+// text/template executed with a mockRequest.
+type MockResponse struct {
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Delay   string            `json:"delay,omitempty"`
+}
+
+// mockRequest is the data available to body templates.
+type mockRequest struct {
+	Method string
+	URL    string
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+	Params map[string]string
+	Now    time.Time
+}
+
+var mockTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// compiledMock is a MockRule ready to match.
+type compiledMock struct {
+	rule  MockRule
+	path  *regexp.Regexp
+	body  *regexp.Regexp
+	query map[string]*regexp.Regexp
+	tmpl  *template.Template
+	delay time.Duration
+	hits  atomic.Int64
+
+	// key is the rule's JSON form, used to carry hits across edits
+	key string
+}
+
+func compileMock(index int, rule MockRule) (*compiledMock, error) {
+	label := rule.Name
+	if label == "" {
+		label = fmt.Sprintf("#%d", index+1)
+	}
+	fail := func(format string, args ...any) (*compiledMock, error) {
+		return nil, fmt.Errorf("mock %s: %s", label, fmt.Sprintf(format, args...))
+	}
+
+	c := &compiledMock{rule: rule}
+	key, err := json.Marshal(rule)
+	if err != nil {
+		return fail("%v", err)
+	}
+	c.key = string(key)
+	if rule.Match.Path != "" {
+		if c.path, err = regexp.Compile(rule.Match.Path); err != nil {
+			return fail("path: %v", err)
+		}
+	}
+	if rule.Match.Body != "" {
+		if c.body, err = regexp.Compile(rule.Match.Body); err != nil {
+			return fail("body: %v", err)
+		}
+	}
+	for name, pattern := range rule.Match.Query {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fail("query %s: %v", name, err)
+		}
+		if c.query == nil {
+			c.query = make(map[string]*regexp.Regexp)
+		}
+		c.query[name] = re
+	}
+	if status := rule.Response.Status; status != 0 && (status < 100 || status > 999) {
+		return fail("status %d is out of range", status)
+	}
+	if rule.Response.Delay != "" {
+		if c.delay, err = time.ParseDuration(rule.Response.Delay); err != nil || c.delay < 0 {
+			return fail("delay: %q is not a duration", rule.Response.Delay)
+		}
+	}
+	if c.tmpl, err = template.New(label).Funcs(mockTemplateFuncs).Option("missingkey=zero").Parse(rule.Response.Body); err != nil {
+		return fail("body template: %v", err)
+	}
+	return c, nil
+}
+
+func compileMocks(rules []MockRule) ([]*compiledMock, error) {
+	compiled := make([]*compiledMock, 0, len(rules))
+	for i, rule := range rules {
+		c, err := compileMock(i, rule)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// carryHits copies hit counts from old rules to identical new ones, so
+// editing one rule does not reset the others.
+func carryHits(old, updated []*compiledMock) {
+	counts := make(map[string][]int64)
+	for _, c := range old {
+		counts[c.key] = append(counts[c.key], c.hits.Load())
+	}
+	for _, c := range updated {
+		if n := counts[c.key]; len(n) > 0 {
+			c.hits.Store(n[0])
+			counts[c.key] = n[1:]
+		}
+	}
+}
+
+func (c *compiledMock) label() string {
+	if c.rule.Name != "" {
+		return c.rule.Name
+	}
+	return c.tmpl.Name()
+}
+
+// match reports whether the request hits this rule, and returns the path
+// capture groups by name and by number.
+func (c *compiledMock) match(req *http.Request, body func() string) (map[string]string, bool) {
+	m := c.rule.Match
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return nil, false
+	}
+	if m.Host != "" && !matchHostPattern(m.Host, req.URL.Hostname()) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	if c.path != nil {
+		groups := c.path.FindStringSubmatch(req.URL.Path)
+		if groups == nil {
+			return nil, false
+		}
+		for i, name := range c.path.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			params[strconv.Itoa(i)] = groups[i]
+			if name != "" {
+				params[name] = groups[i]
+			}
+		}
+	}
+
+	query := req.URL.Query()
+	for name, re := range c.query {
+		if !query.Has(name) || !re.MatchString(query.Get(name)) {
+			return nil, false
+		}
+	}
+	if c.body != nil && !c.body.MatchString(body()) {
+		return nil, false
+	}
+	return params, true
+}
+
+// MockModule answers requests from a JSON file of stub rules. The file is
+// re-read when it changes and can be edited through /api/mocks. YAML is not
+// supported: the proxy has no YAML parser and writes edits back as JSON.
+type MockModule struct {
+	name string
+	path string
+
+	mu        sync.Mutex
+	rules     []*compiledMock
+	stamp     string
+	checked   time.Time
+	loadError string
+}
+
+func newMockModule(p *moduleParams) (configuredModule, error) {
+	file, ok := p.last("file")
+	if !ok {
+		return configuredModule{}, p.missing("file")
+	}
+	if ext := strings.ToLower(filepath.Ext(file.Value)); ext == ".yaml" || ext == ".yml" {
+		return configuredModule{}, p.errorf(file.Source, "%s: mock rules must be JSON; YAML files are not supported", file.Value)
+	}
+	m := &MockModule{name: p.config.Name, path: file.Value}
+	if err := m.load(); err != nil {
+		return configuredModule{}, p.errorf(file.Source, "%v", err)
+	}
+	return configuredModule{module: m}, nil
+}
+
+// load reads the file; a missing file means no rules yet. On failure the
+// previous rules stay in place. The caller holds m.mu, except during
+// construction.
+func (m *MockModule) load() error {
+	m.stamp = fileStamp(m.path)
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		m.rules, m.loadError = nil, ""
+		return nil
+	}
+	var rules []MockRule
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&rules); err != nil {
+			err = fmt.Errorf("%s: %v", m.path, err)
+		}
+	}
+	var compiled []*compiledMock
+	if err == nil {
+		if compiled, err = compileMocks(rules); err != nil {
+			err = fmt.Errorf("%s: %v", m.path, err)
+		}
+	}
+	if err != nil {
+		m.loadError = err.Error()
+		return err
+	}
+	carryHits(m.rules, compiled)
+	m.rules, m.loadError = compiled, ""
+	return nil
+}
+
+func (m *MockModule) current() []*compiledMock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshLocked()
+	return m.rules
+}
+
+// refreshLocked reloads the file when it changed on disk. The caller
+// holds m.mu.
+func (m *MockModule) refreshLocked() {
+	if time.Since(m.checked) >= scriptCheckInterval {
+		m.checked = time.Now()
+		if stamp := fileStamp(m.path); stamp != m.stamp {
+			if err := m.load(); err != nil {
+				log.Printf("[MOCK] %s: keeping the previous rules: %v", m.name, err)
+			} else {
+				log.Printf("[MOCK] %s: reloaded %s (%d rules)", m.name, m.path, len(m.rules))
+			}
+		}
+	}
+}
+
+// update applies edit to the current rules, then validates the result,
+// writes it to the file and makes it current, all under m.mu so
+// concurrent edits don't lose each other. Unchanged rules keep their hits.
+func (m *MockModule) update(edit func(rules []MockRule) ([]MockRule, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshLocked()
+
+	rules := make([]MockRule, 0, len(m.rules))
+	for _, c := range m.rules {
+		rules = append(rules, c.rule)
+	}
+	rules, err := edit(rules)
+	if err != nil {
+		return err
+	}
+	compiled, err := compileMocks(rules)
+	if err != nil {
+		return err
+	}
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(rules); err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	carryHits(m.rules, compiled)
+	m.rules, m.loadError = compiled, ""
+	m.stamp = fileStamp(m.path)
+	log.Printf("[MOCK] %s: saved %d rules to %s", m.name, len(rules), m.path)
+	return nil
+}
+
+func (m *MockModule) Name() string {
+	return fmt.Sprintf("Mock(%s)", m.name)
+}
+
+func (m *MockModule) RuleStats() RuleStats {
+	rules := m.current()
+	var hits int64
+	for _, rule := range rules {
+		hits += rule.hits.Load()
+	}
+	return RuleStats{Name: m.name, Type: "mock", Description: fmt.Sprintf("%d rules from %s", len(rules), m.path), Hits: hits}
+}
+
+func (m *MockModule) HandleRequest(x *Exchange) error {
+	req := x.Request
+	var body *string
+	readBody := func() string {
+		if body == nil {
+			raw, _ := readAndRestoreRequestBody(req)
+			plain, err := decodeContent(raw, req.Header.Get("Content-Encoding"))
+			if err != nil {
+				plain = raw
+			}
+			s := string(plain)
+			body = &s
+		}
+		return *body
+	}
+
+	for _, rule := range m.current() {
+		if rule.rule.Disabled {
+			continue
+		}
+		params, ok := rule.match(req, readBody)
+		if !ok {
+			continue
+		}
+		rule.hits.Add(1)
+		return m.respond(x, rule, params, readBody())
+	}
+	return nil
+}
+
+func (m *MockModule) respond(x *Exchange, rule *compiledMock, params map[string]string, body string) error {
+	req := x.Request
+	data := mockRequest{
+		Method: req.Method,
+		URL:    x.ClientURL,
+		Host:   req.URL.Hostname(),
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header,
+		Body:   body,
+		Params: params,
+		Now:    time.Now(),
+	}
+
+	status := rule.rule.Response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := make(http.Header)
+	for name, value := range rule.rule.Response.Headers {
+		header.Set(name, value)
+	}
+
+	var out strings.Builder
+	if err := rule.tmpl.Execute(&out, data); err != nil {
+		status = http.StatusInternalServerError
+		header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		out.Reset()
+		fmt.Fprintf(&out, "mock %s: %v\n", rule.label(), err)
+	}
+
+	if rule.delay > 0 {
+		select {
+		case <-time.After(rule.delay):
+		case <-req.Context().Done():
+			return ErrDropExchange
+		}
+	}
+
+	x.Respond(status, header, out.String())
+	x.MapType, x.MapTarget = "mock", m.name+"/"+rule.label()
+	return nil
+}
+
+func (m *MockModule) HandleResponse(x *Exchange) error {
+	return nil
+}
+
+// MockSet is one mock module as listed at /api/mocks.
+type MockSet struct {
+	Module    string     `json:"module"`
+	File      string     `json:"file"`
+	LoadError string     `json:"load_error,omitempty"`
+	Rules     []MockRule `json:"rules"`
+	Hits      []int64    `json:"hits"`
+}
+
+func (m *MockModule) set() MockSet {
+	rules := m.current()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MockSet{Module: m.name, File: m.path, LoadError: m.loadError, Rules: []MockRule{}, Hits: []int64{}}
+	for _, rule := range rules {
+		s.Rules = append(s.Rules, rule.rule)
+		s.Hits = append(s.Hits, rule.hits.Load())
+	}
+	return s
+}
+
+func mockModules() []*MockModule {
+	var modules []*MockModule
+	for _, module := range currentPipeline().modules {
+		if mock, ok := module.ExchangeModule.(*MockModule); ok {
+			modules = append(modules, mock)
+		}
+	}
+	return modules
+}
+
+// handleAPIMocks lists mock rules (GET), replaces a module's rules (PUT,
+// a JSON array), appends one rule (POST) or deletes one by index (DELETE
+// ?index=N). ?module=NAME is needed when more than one mock module is
+// configured.
+func handleAPIMocks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	modules := mockModules()
+
+	if r.Method == http.MethodGet {
+		sets := []MockSet{}
+		for _, m := range modules {
+			sets = append(sets, m.set())
+		}
+		json.NewEncoder(w).Encode(sets)
+		return
+	}
+	if !mutationAllowed(w, r) {
+		return
+	}
+
+	fail := func(status int, format string, args ...any) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf(format, args...)})
+	}
+
+	var module *MockModule
+	name := r.URL.Query().Get("module")
+	for _, m := range modules {
+		if m.name == name || (name == "" && len(modules) == 1) {
+			module = m
+		}
+	}
+	if module == nil {
+		fail(http.StatusNotFound, "no mock module %q (configured: %d)", name, len(modules))
+		return
+	}
+
+	decode := func(v any) bool {
+		decoder := json.NewDecoder(io.LimitReader(r.Body, 4<<20))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(v); err != nil {
+			fail(http.StatusBadRequest, "invalid JSON: %v", err)
+			return false
+		}
+		return true
+	}
+
+	// The edit runs against the rules current at save time
+	status := http.StatusUnprocessableEntity
+	var edit func(rules []MockRule) ([]MockRule, error)
+	switch r.Method {
+	case http.MethodPut:
+		var replacement []MockRule
+		if !decode(&replacement) {
+			return
+		}
+		edit = func([]MockRule) ([]MockRule, error) {
+			return replacement, nil
+		}
+	case http.MethodPost:
+		var rule MockRule
+		if !decode(&rule) {
+			return
+		}
+		edit = func(rules []MockRule) ([]MockRule, error) {
+			return append(rules, rule), nil
+		}
+	case http.MethodDelete:
+		index, err := strconv.Atoi(r.URL.Query().Get("index"))
+		edit = func(rules []MockRule) ([]MockRule, error) {
+			if err != nil || index < 0 || index >= len(rules) {
+				status = http.StatusBadRequest
+				return nil, fmt.Errorf("index must be between 0 and %d", len(rules)-1)
+			}
+			return slices.Delete(rules, index, index+1), nil
+		}
+	default:
+		fail(http.StatusMethodNotAllowed, "use GET, PUT, POST or DELETE")
+		return
+	}
+
+	if err := module.update(edit); err != nil {
+		fail(status, "%v", err)
+		return
+	}
+	json.NewEncoder(w).Encode(module.set())
+}
+
+// ============================================================================
+// NETWORK CONDITIONS
+// ============================================================================
+
+// tlsHandshakeFailureAlert is a fatal handshake_failure alert record.
+var tlsHandshakeFailureAlert = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}
+
+var errNetworkTruncate = errors.New("network profile: response truncated")
+
+// NetworkModule is a network condition profile for some hosts: added
+// latency, bandwidth caps and injected faults. Profiles can be switched
+// on and off from the monitor.
+type NetworkModule struct {
+	name          string
+	faultKey      string
+	hosts         []string
+	latency       time.Duration
+	jitter        time.Duration
+	downloadBps   int64
+	uploadBps     int64
+	errorRate     float64
+	errorStatus   []int
+	resetRate     float64
+	truncateRate  float64
+	handshakeRate float64
+
+	active            atomic.Bool
+	exchanges         atomic.Int64
+	errorsInjected    atomic.Int64
+	resets            atomic.Int64
+	truncations       atomic.Int64
+	handshakeFailures atomic.Int64
+}
+
+// rate reads a probability written as 0.05 or 5%.
+func (p *moduleParams) rate(key string) (float64, error) {
+	param, ok := p.last(key)
+	if !ok {
+		return 0, nil
+	}
+	value, scale := param.Value, 1.0
+	if strings.HasSuffix(value, "%") {
+		value, scale = strings.TrimSuffix(value, "%"), 100
+	}
+	r, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || r < 0 || r/scale > 1 {
+		return 0, p.errorf(param.Source, "%s: %q is not a probability like 0.05 or 5%%", key, param.Value)
+	}
+	return r / scale, nil
+}
+
+func newNetworkModule(p *moduleParams) (configuredModule, error) {
+	m := &NetworkModule{name: p.config.Name, faultKey: "network.fault." + p.config.Name, hosts: p.list("hosts")}
+	var err error
+	if m.latency, err = p.duration("latency", 0); err != nil {
+		return configuredModule{}, err
+	}
+	if m.jitter, err = p.duration("jitter", 0); err != nil {
+		return configuredModule{}, err
+	}
+
+	download, err := p.integer("download_kbps", 0)
+	if err != nil {
+		return configuredModule{}, err
+	}
+	upload, err := p.integer("upload_kbps", 0)
+	if err != nil {
+		return configuredModule{}, err
+	}
+	m.downloadBps, m.uploadBps = int64(download)*125, int64(upload)*125
+
+	for _, r := range []struct {
+		key  string
+		dest *float64
+	}{
+		{"error_rate", &m.errorRate},
+		{"reset_rate", &m.resetRate},
+		{"truncate_rate", &m.truncateRate},
+		{"handshake_fail_rate", &m.handshakeRate},
+	} {
+		if *r.dest, err = p.rate(r.key); err != nil {
+			return configuredModule{}, err
+		}
+	}
+
+	m.errorStatus = []int{http.StatusServiceUnavailable}
+	if statuses := p.list("error_status"); len(statuses) > 0 {
+		param, _ := p.last("error_status")
+		m.errorStatus = nil
+		for _, s := range statuses {
+			status, err := strconv.Atoi(s)
+			if err != nil || status < 500 || status > 599 {
+				return configuredModule{}, p.errorf(param.Source, "error_status: %q is not a 5xx status", s)
+			}
+			m.errorStatus = append(m.errorStatus, status)
+		}
+	}
+
+	active, err := p.boolean("active", true)
+	if err != nil {
+		return configuredModule{}, err
+	}
+	m.active.Store(active)
+	return configuredModule{module: m}, nil
+}
+
+func (m *NetworkModule) Name() string {
+	return fmt.Sprintf("Network(%s)", m.name)
+}
+
+func (m *NetworkModule) matches(hostname string) bool {
+	return len(m.hosts) == 0 || slices.ContainsFunc(m.hosts, func(h string) bool { return matchHostPattern(h, hostname) })
+}
+
+func (m *NetworkModule) delay() time.Duration {
+	d := m.latency
+	if m.jitter > 0 {
+		d += time.Duration(mrand.Int64N(int64(2*m.jitter))) - m.jitter
+	}
+	return max(d, 0)
+}
+
+func roll(probability float64) bool {
+	return probability > 0 && mrand.Float64() < probability
+}
+
+func (m *NetworkModule) HandleRequest(x *Exchange) error {
+	if !m.active.Load() || !m.matches(x.Request.URL.Hostname()) {
+		return nil
+	}
+	m.exchanges.Add(1)
+
+	if d := m.delay(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-x.Request.Context().Done():
+			return ErrDropExchange
+		}
+	}
+
+	switch {
+	case roll(m.errorRate):
+		status := m.errorStatus[mrand.IntN(len(m.errorStatus))]
+		x.Respond(status, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, fmt.Sprintf("network profile %s: injected %d\n", m.name, status))
+		x.MapType, x.MapTarget = "fault", fmt.Sprintf("%s: %d", m.name, status)
+		m.errorsInjected.Add(1)
+	case roll(m.resetRate):
+		x.Set(m.faultKey, ErrResetExchange)
+		x.MapType, x.MapTarget = "fault", m.name+": reset"
+	case roll(m.truncateRate):
+		x.Set(m.faultKey, errNetworkTruncate)
+		x.MapType, x.MapTarget = "fault", m.name+": truncated"
+	}
+	return nil
+}
+
+// HandleResponse cuts the body short for reset and truncate faults. The
+// full length is still announced, so the client sees a broken transfer.
+func (m *NetworkModule) HandleResponse(x *Exchange) error {
+	value, _ := x.Get(m.faultKey)
+	fault, ok := value.(error)
+	if !ok {
+		return nil
+	}
+	x.Set(m.faultKey, nil)
+
+	resp := x.Response
+	body, err := readAndRestoreResponseBody(resp)
+	if err != nil {
+		return nil
+	}
+	if fault == ErrResetExchange {
+		m.resets.Add(1)
+	} else {
+		m.truncations.Add(1)
+	}
+	cut := 0
+	if len(body) > 1 {
+		cut = 1 + mrand.IntN(len(body)-1)
+	}
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:cut]), errorReader{fault}))
+	return nil
+}
+
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// failHandshake reports whether this connection's TLS handshake should be
+// refused.
+func (m *NetworkModule) failHandshake() bool {
+	if !roll(m.handshakeRate) {
+		return false
+	}
+	m.handshakeFailures.Add(1)
+	return true
+}
+
+func (m *NetworkModule) RuleStats() RuleStats {
+	faults := m.errorsInjected.Load() + m.resets.Load() + m.truncations.Load() + m.handshakeFailures.Load()
+	return RuleStats{Name: m.name, Type: "network", Description: m.describe(), Hits: faults}
+}
+
+func (m *NetworkModule) describe() string {
+	var parts []string
+	if len(m.hosts) > 0 {
+		parts = append(parts, strings.Join(m.hosts, ","))
+	}
+	if m.latency > 0 || m.jitter > 0 {
+		parts = append(parts, fmt.Sprintf("latency %s±%s", m.latency, m.jitter))
+	}
+	if m.downloadBps > 0 {
+		parts = append(parts, fmt.Sprintf("down %dkbps", m.downloadBps/125))
+	}
+	if m.uploadBps > 0 {
+		parts = append(parts, fmt.Sprintf("up %dkbps", m.uploadBps/125))
+	}
+	for _, r := range []struct {
+		name string
+		rate float64
+	}{{"5xx", m.errorRate}, {"reset", m.resetRate}, {"truncate", m.truncateRate}, {"handshake", m.handshakeRate}} {
+		if r.rate > 0 {
+			parts = append(parts, fmt.Sprintf("%s %g%%", r.name, r.rate*100))
+		}
+	}
+	if !m.active.Load() {
+		parts = append(parts, "(off)")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// networkProfile returns the first network profile for hostname. With
+// activeOnly unset, switched-off profiles count too, so connections can be
+// shaped once a profile is switched on.
+func networkProfile(hostname string, activeOnly bool) *NetworkModule {
+	for _, module := range currentPipeline().modules {
+		if m, ok := module.ExchangeModule.(*NetworkModule); ok && m.matches(hostname) && (!activeOnly || m.active.Load()) {
+			return m
+		}
+	}
+	return nil
+}
+
+// shapedConn caps the bandwidth of a connection by the profile currently
+// active for its client's host. On the client side reads are uploads and
+// writes downloads; an upstream leg (see upstreamLeg) is the other way
+// round.
+type shapedConn struct {
+	net.Conn
+	hostname string
+	upstream bool
+	// in and out pace what is read and written; inPos and outPos are this
+	// leg's position in those streams.
+	in, out       *pacer
+	inPos, outPos int64
+}
+
+// shapeConn wraps a client conn if any network profile covers hostname.
+func shapeConn(conn net.Conn, hostname string) net.Conn {
+	if networkProfile(hostname, false) == nil {
+		return conn
+	}
+	return &shapedConn{Conn: conn, hostname: hostname, in: &pacer{}, out: &pacer{}}
+}
+
+// upstreamLeg prepares the shaping of connections to the server for the
+// exchange starting on w, or returns nil when w isn't shaped. The leg
+// shares the client's pacers with the directions swapped and starts where
+// the client is now, so the upstream sees the same slow client and relayed
+// bytes are paid for once, even when the proxy buffers them in between.
+func upstreamLeg(w io.Writer) *shapedConn {
+	conn, _ := w.(net.Conn)
+	for conn != nil {
+		if c, ok := conn.(*shapedConn); ok {
+			return &shapedConn{
+				hostname: c.hostname,
+				upstream: true,
+				in:       c.out,
+				out:      c.in,
+				inPos:    c.outPos,
+				outPos:   c.inPos,
+			}
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = inner.NetConn()
+	}
+	return nil
+}
+
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// rates returns the caps for reading and writing.
+func (c *shapedConn) rates() (in, out int64) {
+	m := networkProfile(c.hostname, true)
+	switch {
+	case m == nil:
+		return 0, 0
+	case c.upstream:
+		return m.downloadBps, m.uploadBps
+	}
+	return m.uploadBps, m.downloadBps
+}
+
+// throttleChunk sends at most 1/20 s worth of data at a time.
+func throttleChunk(bps int64, n int) int {
+	if chunk := int(max(bps/20, 1)); bps > 0 && n > chunk {
+		return chunk
+	}
+	return n
+}
+
+// pacer is a token bucket holding 1/20 s worth of data for one direction
+// of a client connection and its upstream legs. Only bytes past the
+// furthest position any leg has reached are charged: a response read from
+// the server and then relayed to the client pays once, even when the proxy
+// buffered it in between.
+type pacer struct {
+	mu     sync.Mutex
+	paid   int64
+	credit float64
+	last   time.Time
+}
+
+// advance moves a leg to pos and sleeps off what bps can't carry yet.
+func (p *pacer) advance(bps, pos int64) {
+	p.mu.Lock()
+	n := pos - p.paid
+	if n <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.paid = pos
+	if bps <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	burst := float64(max(bps/20, 1))
+	if p.last.IsZero() {
+		p.credit = burst
+	} else {
+		p.credit = min(burst, p.credit+now.Sub(p.last).Seconds()*float64(bps))
+	}
+	p.last = now
+	p.credit -= float64(n)
+	debt := -p.credit
+	p.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / float64(bps) * float64(time.Second)))
+	}
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	in, _ := c.rates()
+	n, err := c.Conn.Read(b[:throttleChunk(in, len(b))])
+	c.inPos += int64(n)
+	c.in.advance(in, c.inPos)
+	return n, err
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		_, out := c.rates()
+		n, err := c.Conn.Write(b[:throttleChunk(out, len(b))])
+		written += n
+		c.outPos += int64(n)
+		c.out.advance(out, c.outPos)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// shapedBody caps the upload of a request body that was already split off
+// its connection.
+type shapedBody struct {
+	io.ReadCloser
+	conn *shapedConn
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	upload, _ := b.conn.rates()
+	n, err := b.ReadCloser.Read(p[:throttleChunk(upload, len(p))])
+	b.conn.inPos += int64(n)
+	b.conn.in.advance(upload, b.conn.inPos)
+	return n, err
+}
+
+// resetConnection closes the TCP connection under w with an RST.
+func resetConnection(w io.Writer) {
+	conn, _ := w.(net.Conn)
+	for conn != nil {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+			tcp.Close()
+			return
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = inner.NetConn()
+	}
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// NetworkStatus is a profile as shown at /api/network.
+type NetworkStatus struct {
+	Name              string `json:"name"`
+	Description       string `json:"description"`
+	Active            bool   `json:"active"`
+	Exchanges         int64  `json:"exchanges"`
+	Errors            int64  `json:"errors"`
+	Resets            int64  `json:"resets"`
+	Truncations       int64  `json:"truncations"`
+	HandshakeFailures int64  `json:"handshake_failures"`
+}
+
+func (m *NetworkModule) Status() NetworkStatus {
+	return NetworkStatus{
+		Name:              m.name,
+		Description:       m.describe(),
+		Active:            m.active.Load(),
+		Exchanges:         m.exchanges.Load(),
+		Errors:            m.errorsInjected.Load(),
+		Resets:            m.resets.Load(),
+		Truncations:       m.truncations.Load(),
+		HandshakeFailures: m.handshakeFailures.Load(),
+	}
+}
+
+// handleAPINetwork lists the network profiles; POST
+// ?profile=NAME&active=true|false switches one on or off until the next
+// reload.
+func handleAPINetwork(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var profiles []*NetworkModule
+	for _, module := range currentPipeline().modules {
+		if m, ok := module.ExchangeModule.(*NetworkModule); ok {
+			profiles = append(profiles, m)
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		if !mutationAllowed(w, r) {
+			return
+		}
+		name := r.URL.Query().Get("profile")
+		active, err := strconv.ParseBool(r.URL.Query().Get("active"))
+		i := slices.IndexFunc(profiles, func(m *NetworkModule) bool { return m.name == name })
+		if err != nil || i < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "need ?profile=NAME&active=true|false for a configured profile"})
+			return
+		}
+		profiles[i].active.Store(active)
+		log.Printf("[NETWORK] Profile %s switched %s", name, map[bool]string{true: "on", false: "off"}[active])
+	}
+
+	statuses := []NetworkStatus{}
+	for _, m := range profiles {
+		statuses = append(statuses, m.Status())
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// ============================================================================
+// BLOCK RULES
+// ============================================================================
+
+var blockActions = []string{"status", "refuse", "reset"}
+
+// BlockModule blocks hosts, optionally only some paths. With action
+// "refuse" or "reset" a host-only rule already stops the CONNECT; with
+// "status" the tunnel is set up and every request gets the status.
+type BlockModule struct {
+	name     string
+	scope    ruleScope
+	listed   map[string]bool
+	listFile string
+	action   string
+	status   int
+	body     string
+	counters ruleCounters
+}
+
+func newBlockModule(p *moduleParams) (configuredModule, error) {
+	m := &BlockModule{name: p.config.Name}
+	var err error
+	if m.scope, err = p.requestScope(); err != nil {
+		return configuredModule{}, err
+	}
+
+	if file, ok := p.last("file"); ok {
+		if m.listed, err = loadHostsBlocklist(file.Value); err != nil {
+			return configuredModule{}, p.errorf(file.Source, "file: %v", err)
+		}
+		m.listFile = file.Value
+	}
+	if len(m.scope.hosts) == 0 && m.listFile == "" {
+		return configuredModule{}, p.missing("hosts or file")
+	}
+
+	m.action = "status"
+	if action, ok := p.last("action"); ok {
+		if m.action = strings.ToLower(action.Value); !slices.Contains(blockActions, m.action) {
+			return configuredModule{}, p.errorf(action.Source, "action: %q is not one of %s", action.Value, strings.Join(blockActions, ", "))
+		}
+	}
+	if m.status, err = p.integer("status", http.StatusForbidden); err != nil {
+		return configuredModule{}, err
+	}
+	if m.status < 100 || m.status > 999 {
+		param, _ := p.last("status")
+		return configuredModule{}, p.errorf(param.Source, "status: %d is out of range", m.status)
+	}
+	m.body = fmt.Sprintf("Blocked by proxy rule %s\n", m.name)
+	if body, ok := p.last("body"); ok {
+		m.body = body.Value
+	}
+	if m.status < 200 || m.status == http.StatusNoContent || m.status == http.StatusNotModified {
+		m.body = ""
+	}
+	return configuredModule{module: m}, nil
+}
+
+// loadHostsBlocklist reads a hosts-format file ("0.0.0.0 ads.example.com")
+// or a plain list of host names.
+func loadHostsBlocklist(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, host := range fields {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if host != "localhost" && host != "localhost.localdomain" && net.ParseIP(host) == nil {
+				hosts[host] = true
+			}
+		}
+	}
+	return hosts, nil
+}
+
+func (m *BlockModule) Name() string {
+	return fmt.Sprintf("Block(%s)", m.name)
+}
+
+func (m *BlockModule) RuleStats() RuleStats {
+	target := describeScope(m.scope)
+	if m.listFile != "" {
+		target = fmt.Sprintf("%d hosts from %s", len(m.listed), m.listFile)
+		if len(m.scope.hosts) > 0 {
+			target += " + " + strings.Join(m.scope.hosts, ",")
+		}
+	}
+	return m.counters.stats(m.name, "block", fmt.Sprintf("%s -> %s", target, m.describeAction()))
+}
+
+func (m *BlockModule) describeAction() string {
+	if m.action == "reset" {
+		return "reset"
+	}
+	return fmt.Sprintf("%s %d", m.action, m.status)
+}
+
+func (m *BlockModule) matchesHost(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	if m.listed[hostname] {
+		return true
+	}
+	return slices.ContainsFunc(m.scope.hosts, func(h string) bool { return matchHostPattern(h, hostname) })
+}
+
+// blocksConnect reports whether the rule stops a CONNECT to hostname
+// before any request is seen.
+func (m *BlockModule) blocksConnect(hostname string) bool {
+	return m.action != "status" && m.scope.path == nil && m.matchesHost(hostname)
+}
+
+func (m *BlockModule) HandleRequest(x *Exchange) error {
+	req := x.Request
+	if !m.matchesHost(req.URL.Hostname()) || (m.scope.path != nil && !m.scope.path.MatchString(req.URL.Path)) {
+		return nil
+	}
+	m.counters.hit(0)
+
+	if m.action == "reset" {
+		recordBlocked(x, m, 0)
+		return ErrResetExchange
+	}
+	x.Respond(m.status, http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, m.body)
+	x.MapType, x.MapTarget = "blocked", m.name+": "+m.describeAction()
+	return nil
+}
+
+func (m *BlockModule) HandleResponse(x *Exchange) error {
+	return nil
+}
+
+// connectBlock returns the first rule that stops a CONNECT to hostname.
+func connectBlock(hostname string) *BlockModule {
+	for _, module := range currentPipeline().modules {
+		if m, ok := module.ExchangeModule.(*BlockModule); ok && m.blocksConnect(hostname) {
+			return m
+		}
+	}
+	return nil
+}
+
+// recordBlocked adds a monitor entry for an attempt that never became a
+// normal exchange, if it is in the capture scope.
+func recordBlocked(x *Exchange, m *BlockModule, status int) {
+	if !x.InScope || !slices.ContainsFunc(currentPipeline().modules, func(pm pipelineModule) bool {
+		_, ok := pm.ExchangeModule.(*MonitoringModule)
+		return ok
+	}) {
+		return
+	}
+	entry := TrafficEntry{
+		Timestamp:  time.Now(),
+		Method:     x.Request.Method,
+		URL:        x.ClientURL,
+		Host:       x.Request.URL.Hostname(),
+		Path:       x.Request.URL.Path,
+		StatusCode: status,
+		ClientAddr: x.ClientAddr,
+		MapType:    "blocked",
+		MapTarget:  m.name + ": " + m.describeAction(),
+	}
+	if status != 0 {
+		entry.StatusText = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	}
+	trafficStore.AddEntry(entry)
+}
+
+// refuseConnect answers a blocked CONNECT. It reports true if the
+// connection must be closed without the tunnel.
+func refuseConnect(clientConn net.Conn, req *http.Request, hostname string) bool {
+	m := connectBlock(hostname)
+	if m == nil {
+		return false
+	}
+	m.counters.hit(0)
+	clientAddr := clientConn.RemoteAddr().String()
+	log.Printf("[BLOCK] %s: %s CONNECT %s from %s", m.name, m.action, req.Host, clientAddr)
+
+	// No request inside the tunnel is seen, so the scope is judged on the
+	// CONNECT itself; path filters leave it out
+	x := newExchange(req, clientAddr, nil)
+	x.ClientURL = req.Host
+	x.InScope = currentPipeline().scope.Contains(x)
+
+	if m.action == "reset" {
+		recordBlocked(x, m, 0)
+		resetConnection(clientConn)
+		return true
+	}
+	recordBlocked(x, m, m.status)
+	fmt.Fprintf(clientConn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		m.status, http.StatusText(m.status), len(m.body), m.body)
+	return true
+}
+
+// ============================================================================
+// UPSTREAM DNS
+// ============================================================================
+
+const dnsTimeout = 5 * time.Second
+
+// upstreamDial records which address an upstream connection went to and
+// how the name was resolved. With leg set (see upstreamLeg) the
+// connection is shaped like the client's.
+type upstreamDial struct {
+	IP     string
+	Source string
+	leg    *shapedConn
+}
+
+type upstreamDialKey struct{}
+
+// newDNSResolver builds the resolver for [dns] server: host[:port] or
+// udp://host[:port] or tcp://host[:port] for plain DNS, and http(s):// URLs
+// for DNS over HTTPS. An empty server means the system resolver.
+func newDNSResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return net.DefaultResolver, nil
+	}
+	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://") {
+		if u, err := url.Parse(server); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%q is not a DNS over HTTPS URL", server)
+		}
+		client := &http.Client{Timeout: dnsTimeout}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, url: server, client: client}, nil
+			},
+		}, nil
+	}
+
+	network, addr := "udp", server
+	if scheme, rest, ok := strings.Cut(server, "://"); ok {
+		if scheme != "udp" && scheme != "tcp" {
+			return nil, fmt.Errorf("%q: use udp://, tcp://, http:// or https://", server)
+		}
+		network, addr = scheme, rest
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("%q: %v", server, err)
+	}
+	dialer := &net.Dialer{Timeout: dnsTimeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// dohConn lets the Go resolver speak DNS over HTTPS (RFC 8484). The
+// resolver writes a length-prefixed query as it would over TCP; the answer
+// is fetched with a POST on the first read.
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+	query  bytes.Buffer
+	answer *bytes.Reader
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.query.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.answer == nil {
+		if err := c.exchange(); err != nil {
+			return 0, err
+		}
+	}
+	return c.answer.Read(b)
+}
+
+func (c *dohConn) exchange() error {
+	if c.query.Len() < 2 {
+		return errors.New("dns over https: empty query")
+	}
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(c.query.Bytes()[2:]))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dns over https: %s answered %s", c.url, resp.Status)
+	}
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return err
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	c.answer = bytes.NewReader(append(framed, msg...))
+	return nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var dnsResolverCache struct {
+	sync.Mutex
+	server   string
+	resolver *net.Resolver
+}
+
+// upstreamResolver returns the resolver for the current [dns] server,
+// rebuilding it after a reload changed the setting.
+func upstreamResolver() (*net.Resolver, string) {
+	server := currentConfig().DNSServer
+	dnsResolverCache.Lock()
+	defer dnsResolverCache.Unlock()
+	if dnsResolverCache.resolver == nil || dnsResolverCache.server != server {
+		resolver, err := newDNSResolver(server)
+		if err != nil {
+			log.Printf("[DNS] %v, using the system resolver", err)
+			resolver = net.DefaultResolver
+		}
+		dnsResolverCache.server, dnsResolverCache.resolver = server, resolver
+	}
+	if server == "" {
+		return dnsResolverCache.resolver, "system"
+	}
+	return dnsResolverCache.resolver, server
+}
+
+// resolveUpstream applies [dns_hosts] overrides before asking the resolver.
+func resolveUpstream(ctx context.Context, host string) ([]string, string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, "literal", nil
+	}
+	if value := lookupHostSetting(currentConfig().DNSHosts, host, ""); value != "" {
+		var ips []string
+		for _, ip := range strings.Split(value, ",") {
+			ips = append(ips, strings.TrimSpace(ip))
+		}
+		return ips, "override", nil
+	}
+	resolver, source := upstreamResolver()
+	ips, err := resolver.LookupHost(ctx, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && source != "system" {
+		// The Go resolver names the resolv.conf server, not ours
+		dnsErr.Server = source
+	}
+	return ips, source, err
+}
+
+// dialUpstream connects to addr through resolveUpstream. Only the address
+// changes: callers keep using the original name for SNI and Host.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, source, err := resolveUpstream(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	lastErr := fmt.Errorf("no addresses for %s", host)
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if dial, ok := ctx.Value(upstreamDialKey{}).(*upstreamDial); ok {
+			dial.IP, dial.Source = ip, source
+			if dial.leg != nil {
+				leg := *dial.leg
+				leg.Conn = conn
+				conn = &leg
+			}
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// ============================================================================
+// ACCESS CONTROL
+// ============================================================================
+
+const monitorSessionCookie = "tlsproxy_monitor"
+
+// parseAllowList turns [server] allow entries (IPs or CIDR ranges) into
+// prefixes.
+func parseAllowList(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			addr = addr.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientAllowed checks a remote address against [server] allow. An empty
+// list lets in everyone who can reach the listener.
+func clientAllowed(remoteAddr string) bool {
+	allow := currentConfig().AllowedClients
+	if len(allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	prefixes, _ := parseAllowList(allow)
+	addr = addr.Unmap().WithZone("")
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+func isLoopbackBind(bind string) bool {
+	ip := net.ParseIP(bind)
+	return bind == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// proxyAuthorized checks Proxy-Authorization against [auth] proxy_username
+// and proxy_password. Without a username the proxy is open.
+func proxyAuthorized(req *http.Request) bool {
+	cfg := currentConfig()
+	if cfg.ProxyUsername == "" {
+		return true
+	}
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	userOK := secretEqual(user, cfg.ProxyUsername)
+	passOK := secretEqual(pass, cfg.ProxyPassword)
+	return ok && userOK && passOK
+}
+
+func rejectProxyAuth(clientConn net.Conn) {
+	msg := "Proxy authentication required\r\n"
+	fmt.Fprintf(clientConn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"tlsproxy\"\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(msg), msg)
+}
+
+// monitorSession is the login cookie value; it is derived from the token
+// so the token itself is never stored in the browser.
+func monitorSession(token string) string {
+	sum := sha256.Sum256([]byte("tlsproxy monitor session\x00" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+func monitorAuthorized(r *http.Request) bool {
+	token := currentConfig().MonitorToken
+	if token == "" {
+		return true
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secretEqual(strings.TrimSpace(bearer), token) {
+		return true
+	}
+	cookie, err := r.Cookie(monitorSessionCookie)
+	return err == nil && secretEqual(cookie.Value, monitorSession(token))
+}
+
+// mutationAllowed guards the API calls that change proxy state. Without a
+// monitor_token any page open in the browser could post to them, so they
+// need Content-Type: application/json (which a cross-site form or no-cors
+// fetch cannot send) and must not come from another site by Origin or
+// Sec-Fetch-Site. On refusal it writes the error response.
+func mutationAllowed(w http.ResponseWriter, r *http.Request) bool {
+	refuse := func(status int, message string) bool {
+		log.Printf("[AUTH] %s %s from %s refused: %s", r.Method, r.URL.Path, r.RemoteAddr, message)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return false
+	}
+
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return refuse(http.StatusForbidden, "cross-site request")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return refuse(http.StatusForbidden, "cross-origin request from "+origin)
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return refuse(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+	}
+	return true
+}
+
+// protectMonitor applies the allowlist to every monitor request and, with
+// [auth] monitor_token set, requires a login. The CT submission endpoints
+// stay open for clients that talk to the fake logs.
+func protectMonitor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(r.RemoteAddr) {
+			log.Printf("[AUTH] Monitor request from %s rejected by allowlist", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/login":
+			handleMonitorLogin(w, r)
+		case r.URL.Path == "/logout":
+			http.SetCookie(w, &http.Cookie{Name: monitorSessionCookie, Path: "/", MaxAge: -1})
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		case strings.HasPrefix(r.URL.Path, "/ct/v1/") || monitorAuthorized(r):
+			next.ServeHTTP(w, r)
+		case strings.HasPrefix(r.URL.Path, "/api/"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tlsproxy"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "authentication required"})
+		default:
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+		}
+	})
+}
+
+func handleMonitorLogin(w http.ResponseWriter, r *http.Request) {
+	token := currentConfig().MonitorToken
+	if token == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	message := ""
+	if r.Method == http.MethodPost {
+		if secretEqual(r.PostFormValue("token"), token) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     monitorSessionCookie,
+				Value:    monitorSession(token),
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		log.Printf("[AUTH] Failed monitor login from %s", r.RemoteAddr)
+		// Slow down guessing
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusUnauthorized)
+		message = `<p class="error">Wrong token.</p>`
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <title>TLS Proxy Monitor - Login</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #f5f5f5; display: flex; justify-content: center; padding-top: 120px; }
+        form { background: #fff; padding: 30px; border: 1px solid #e0e0e0; border-radius: 4px; width: 300px; }
+        input { width: 100%%; padding: 8px; margin: 10px 0; box-sizing: border-box; }
+        .error { color: #d32f2f; }
+    </style>
+</head>
+<body>
+    <form method="post" action="/login">
+        <h2>TLS Proxy Monitor</h2>
+        %s
+        <input type="password" name="token" placeholder="Monitor token" autofocus>
+        <button type="submit">Log in</button>
+    </form>
+</body>
+</html>`, message)
+}
+
+// ============================================================================
+// CERTIFICATE MIMICRY
+// ============================================================================
+
+const (
+	mimicOff     = "off"
+	mimicConnect = "connect"
+	mimicLazy    = "lazy"
+)
+
+// UpstreamChainStore keeps the certificate chain each upstream server
+// presented, both for mimicry and for display in the monitor.
+type UpstreamChainStore struct {
+	sync.RWMutex
+	chains map[string][]*x509.Certificate
+}
+
+var upstreamChains = &UpstreamChainStore{chains: make(map[string][]*x509.Certificate)}
+
+// Set records the chain for hostname and reports whether its leaf differs
+// from the one previously seen.
+func (s *UpstreamChainStore) Set(hostname string, chain []*x509.Certificate) bool {
+	if len(chain) == 0 {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if existing, ok := s.chains[hostname]; ok && existing[0].Equal(chain[0]) {
+		return false
+	}
+	s.chains[hostname] = chain
+	return true
+}
+
+func (s *UpstreamChainStore) Get(hostname string) []*x509.Certificate {
+	s.RLock()
+	defer s.RUnlock()
+	return s.chains[hostname]
+}
+
+type CertSummary struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	DNSNames     []string  `json:"dnsNames,omitempty"`
+	IPAddresses  []string  `json:"ipAddresses,omitempty"`
+	SHA256       string    `json:"sha256"`
+	PEM          string    `json:"pem"`
+}
+
+func summarizeCert(cert *x509.Certificate) CertSummary {
+	summary := CertSummary{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.Text(16),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		DNSNames:     cert.DNSNames,
+		SHA256:       certFingerprint(cert),
+		PEM:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+	}
+	for _, ip := range cert.IPAddresses {
+		summary.IPAddresses = append(summary.IPAddresses, ip.String())
+	}
+	return summary
+}
+
+// fetchUpstreamChain performs a throwaway handshake with the real server to
+// see which certificate chain it presents. Verification is skipped on
+// purpose: we only copy attributes, we never trust this connection.
+func fetchUpstreamChain(host string) ([]*x509.Certificate, error) {
+	hostname := strings.Split(host, ":")[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := dialUpstream(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return conn.ConnectionState().PeerCertificates, nil
+}
+
+// mimicExtensions are the extensions copied verbatim from the upstream
+// leaf, besides the ones x509 exposes as fields. Anything tied to the
+// upstream key or issuer (key identifiers, AIA, CRL points, SCTs) is not.
+var mimicExtensions = []asn1.ObjectIdentifier{
+	{1, 3, 6, 1, 5, 5, 7, 1, 3},     // qualified certificate statements
+	{1, 3, 6, 1, 4, 1, 311, 21, 7},  // Microsoft certificate template
+	{1, 3, 6, 1, 4, 1, 311, 21, 10}, // Microsoft application policies
+	{2, 16, 840, 1, 113730, 1, 13},  // Netscape comment
+}
+
+// applyUpstreamProfile copies the identity of the real leaf into a template
+// that will be re-signed by our CA. Upstream SANs are added to the ones
+// already in the template, so the intercepted hostname is always covered.
+func applyUpstreamProfile(template *x509.Certificate, upstream *x509.Certificate) {
+	template.RawSubject = upstream.RawSubject
+	template.Subject = upstream.Subject
+	template.NotBefore = upstream.NotBefore
+	template.NotAfter = upstream.NotAfter
+	template.KeyUsage = upstream.KeyUsage
+	template.ExtKeyUsage = upstream.ExtKeyUsage
+	template.UnknownExtKeyUsage = upstream.UnknownExtKeyUsage
+	template.PolicyIdentifiers = upstream.PolicyIdentifiers
+	template.BasicConstraintsValid = upstream.BasicConstraintsValid
+
+	for _, name := range upstream.DNSNames {
+		if !slices.Contains(template.DNSNames, name) {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	for _, ip := range upstream.IPAddresses {
+		if !slices.ContainsFunc(template.IPAddresses, ip.Equal) {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	template.EmailAddresses = upstream.EmailAddresses
+	template.URIs = upstream.URIs
+
+	for _, ext := range upstream.Extensions {
+		if !ext.Critical && slices.ContainsFunc(mimicExtensions, ext.Id.Equal) {
+			template.ExtraExtensions = append(template.ExtraExtensions, ext)
+		}
+	}
+}
+
+// upstreamLeafFor returns the leaf to mimic for hostname, dialing the real
+// server first when mimic_upstream = connect.
+func upstreamLeafFor(host string) *x509.Certificate {
+	if currentConfig().MimicUpstream == mimicOff {
+		return nil
+	}
+
+	hostname := strings.Split(host, ":")[0]
+	if currentConfig().MimicUpstream == mimicConnect && upstreamChains.Get(hostname) == nil {
+		chain, err := fetchUpstreamChain(host)
+		if err != nil {
+			log.Printf("[MIMIC] Could not fetch upstream certificate for %s: %v", host, err)
+			return nil
+		}
+		upstreamChains.Set(hostname, chain)
+	}
+
+	if chain := upstreamChains.Get(hostname); len(chain) > 0 {
+		return chain[0]
+	}
+	return nil
+}
+
+// recordUpstreamChain stores the chain seen while forwarding a request. In
+// lazy mode a changed leaf drops the cached cert so the next handshake for
+// that host is minted from it.
+func recordUpstreamChain(hostname string, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	if upstreamChains.Set(hostname, state.PeerCertificates) && currentConfig().MimicUpstream == mimicLazy {
+		certCache.Invalidate(hostname)
+	}
+}
+
+func handleAPIUpstreamCerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	hostname := strings.TrimPrefix(r.URL.Path, "/api/upstream-certs/")
+	chain := upstreamChains.Get(hostname)
+	if chain == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	summaries := make([]CertSummary, 0, len(chain))
+	for _, cert := range chain {
+		summaries = append(summaries, summarizeCert(cert))
+	}
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// ============================================================================
+// REVOCATION: OCSP RESPONDER AND CRL SERVER
+// ============================================================================
+
+// The standard library has no OCSP package, so the handful of RFC 6960
+// structures the responder needs are declared here for encoding/asn1.
+
+var (
+	oidOCSPBasic       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspSingleRequest struct {
+	Cert       ocspCertID
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type RevokedCert struct {
+	SerialNumber string    `json:"serialNumber"`
+	Host         string    `json:"host,omitempty"`
+	RevokedAt    time.Time `json:"revokedAt"`
+	Reason       int       `json:"reason"`
+	serial       *big.Int
+}
+
+type RevocationStore struct {
+	sync.RWMutex
+	revoked   map[string]*RevokedCert
+	crlNumber int64
+	staples   map[string]*ocspStaple
+}
+
+type ocspStaple struct {
+	der      []byte
+	produced time.Time
+	revoked  bool
+}
+
+var revocations = &RevocationStore{
+	revoked:   make(map[string]*RevokedCert),
+	crlNumber: time.Now().Unix(),
+	staples:   make(map[string]*ocspStaple),
+}
+
+const ocspValidity = time.Hour
+
+func (s *RevocationStore) Revoke(serial *big.Int, host string, reason int) *RevokedCert {
+	s.Lock()
+	defer s.Unlock()
+
+	key := serial.Text(16)
+	if existing, ok := s.revoked[key]; ok {
+		return existing
+	}
+	entry := &RevokedCert{
+		SerialNumber: key,
+		Host:         host,
+		RevokedAt:    time.Now(),
+		Reason:       reason,
+		serial:       serial,
+	}
+	s.revoked[key] = entry
+	log.Printf("[REVOCATION] Revoked serial %s (%s)", key, host)
+	return entry
+}
+
+func (s *RevocationStore) Unrevoke(serialHex string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	serialHex = strings.ToLower(serialHex)
+	if _, ok := s.revoked[serialHex]; !ok {
+		return false
+	}
+	delete(s.revoked, serialHex)
+	return true
+}
+
+func (s *RevocationStore) Lookup(serial *big.Int) *RevokedCert {
+	s.RLock()
+	defer s.RUnlock()
+	return s.revoked[serial.Text(16)]
+}
+
+func (s *RevocationStore) List() []RevokedCert {
+	s.RLock()
+	defer s.RUnlock()
+
+	list := make([]RevokedCert, 0, len(s.revoked))
+	for _, entry := range s.revoked {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].RevokedAt.Before(list[j].RevokedAt)
+	})
+	return list
+}
+
+// CRL returns a freshly signed DER CRL listing every revoked serial.
+func (s *RevocationStore) CRL() ([]byte, error) {
+	s.Lock()
+	s.crlNumber++
+	number := s.crlNumber
+	entries := make([]x509.RevocationListEntry, 0, len(s.revoked))
+	for _, entry := range s.revoked {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   entry.serial,
+			RevocationTime: entry.RevokedAt,
+			ReasonCode:     entry.Reason,
+		})
+	}
+	s.Unlock()
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(ocspValidity),
+		RevokedCertificateEntries: entries,
+	}
+	ca := currentCA()
+	return x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+}
+
+// Staple returns a cached OCSP response for leaf, re-signing it when it is
+// getting old or the leaf's revocation status changed.
+func (s *RevocationStore) Staple(leaf *x509.Certificate) []byte {
+	if leaf == nil {
+		return nil
+	}
+
+	key := leaf.SerialNumber.Text(16)
+	revoked := s.Lookup(leaf.SerialNumber) != nil
+
+	s.RLock()
+	staple, ok := s.staples[key]
+	s.RUnlock()
+	if ok && staple.revoked == revoked && time.Since(staple.produced) < ocspValidity/2 {
+		return staple.der
+	}
+
+	certID, err := ocspCertIDFor(currentCA().cert, leaf.SerialNumber, oidSHA1)
+	if err != nil {
+		return nil
+	}
+	der, err := createOCSPResponse([]ocspCertID{certID})
+	if err != nil {
+		log.Printf("[OCSP] Failed to create staple for %s: %v", leaf.Subject.CommonName, err)
+		return nil
+	}
+
+	s.Lock()
+	s.staples[key] = &ocspStaple{der: der, produced: time.Now(), revoked: revoked}
+	s.Unlock()
+	return der
+}
+
+func hashForOID(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, true
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	}
+	return 0, false
+}
+
+func ocspCertIDFor(issuer *x509.Certificate, serial *big.Int, hashOID asn1.ObjectIdentifier) (ocspCertID, error) {
+	hash, ok := hashForOID(hashOID)
+	if !ok {
+		return ocspCertID{}, fmt.Errorf("unsupported hash algorithm %v", hashOID)
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+
+	nameHash := hash.New()
+	nameHash.Write(issuer.RawSubject)
+	keyHash := hash.New()
+	keyHash.Write(spki.PublicKey.RightAlign())
+
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: hashOID, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash.Sum(nil),
+		IssuerKeyHash: keyHash.Sum(nil),
+		SerialNumber:  serial,
+	}, nil
+}
+
+func signatureAlgorithmFor(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported CA key type %T", key.Public())
+}
+
+// createOCSPResponse answers for each requested certificate: good or revoked
+// when it was issued by our CA, unknown otherwise. The CA signs the response
+// itself rather than through a delegated responder certificate.
+func createOCSPResponse(ids []ocspCertID) ([]byte, error) {
+	ca := currentCA()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	responses := make([]ocspSingleResponse, 0, len(ids))
+	for _, id := range ids {
+		single := ocspSingleResponse{
+			CertID:     id,
+			ThisUpdate: now,
+			NextUpdate: now.Add(ocspValidity),
+		}
+
+		ours, err := ocspCertIDFor(ca.cert, id.SerialNumber, id.HashAlgorithm.Algorithm)
+		switch {
+		case err != nil || !bytes.Equal(ours.NameHash, id.NameHash) || !bytes.Equal(ours.IssuerKeyHash, id.IssuerKeyHash):
+			single.Unknown = true
+		case revocations.Lookup(id.SerialNumber) != nil:
+			revoked := revocations.Lookup(id.SerialNumber)
+			single.Revoked = ocspRevokedInfo{
+				RevocationTime: revoked.RevokedAt.UTC().Truncate(time.Second),
+				Reason:         asn1.Enumerated(revoked.Reason),
+			}
+		default:
+			single.Good = true
+		}
+		responses = append(responses, single)
+	}
+
+	keyID, err := ocspCertIDFor(ca.cert, big.NewInt(0), oidSHA1)
+	if err != nil {
+		return nil, err
+	}
+	keyHashDER, err := asn1.Marshal(keyID.IssuerKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHashDER},
+		ProducedAt:  now,
+		Responses:   responses,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sigAlg, err := signatureAlgorithmFor(ca.key)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(tbs)
+	signature, err := ca.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: sigAlg,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponse{
+		Status:   ocspSuccessful,
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basic},
+	})
+}
+
+func ocspErrorResponse(status int) []byte {
+	der, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return der
+}
+
+func handleOCSP(w http.ResponseWriter, r *http.Request) {
+	var reqDER []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		encoded := strings.TrimPrefix(r.URL.Path, "/ocsp/")
+		if unescaped, unescapeErr := url.PathUnescape(encoded); unescapeErr == nil {
+			encoded = unescaped
+		}
+		reqDER, err = base64.StdEncoding.DecodeString(encoded)
+	case http.MethodPost:
+		reqDER, err = io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+
+	var req ocspRequest
+	if err == nil {
+		_, err = asn1.Unmarshal(reqDER, &req)
+	}
+	if err != nil || len(req.TBSRequest.RequestList) == 0 {
+		log.Printf("[OCSP] Malformed request from %s", r.RemoteAddr)
+		w.Write(ocspErrorResponse(ocspMalformedRequest))
+		return
+	}
+
+	ids := make([]ocspCertID, 0, len(req.TBSRequest.RequestList))
+	for _, single := range req.TBSRequest.RequestList {
+		ids = append(ids, single.Cert)
+	}
+
+	resp, err := createOCSPResponse(ids)
+	if err != nil {
+		log.Printf("[OCSP] Failed to create response: %v", err)
+		w.Write(ocspErrorResponse(ocspInternalError))
+		return
+	}
+
+	log.Printf("[OCSP] Answered %d request(s) from %s", len(ids), r.RemoteAddr)
+	w.Write(resp)
+}
+
+func handleCRL(w http.ResponseWriter, r *http.Request) {
+	crl, err := revocations.CRL()
+	if err != nil {
+		log.Printf("[CRL] Failed to create CRL: %v", err)
+		http.Error(w, "Failed to create CRL", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+func handleCAIssuer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.Write(currentCA().cert.Raw)
+}
+
+// responderBaseURL is the prefix embedded into leaves for OCSP, CRL and
+// issuer lookups.
+func responderBaseURL() string {
+	cfg := currentConfig()
+	if cfg.ResponderURL != "" {
+		return strings.TrimSuffix(cfg.ResponderURL, "/")
+	}
+	return "http://" + cfg.ResponderAddr
+}
+
+func StartRevocationResponder(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ocsp", handleOCSP)
+	mux.HandleFunc("/ocsp/", handleOCSP)
+	mux.HandleFunc("/crl", handleCRL)
+	mux.HandleFunc("/ca.crt", handleCAIssuer)
+
+	log.Printf("[REVOCATION] Starting OCSP/CRL responder on %s (%s)", addr, responderBaseURL())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("[REVOCATION] Server error: %v", err)
+		}
+	}()
+}
+
+// handleAPIRevocations lists (GET), adds (POST) and removes (DELETE)
+// revoked leaves. POST accepts either a hostname from the cert cache or a
+// hex serial number.
+func handleAPIRevocations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(revocations.List())
+	case http.MethodPost:
+		var body struct {
+			Host   string `json:"host"`
+			Serial string `json:"serial"`
+			Reason int    `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		var serial *big.Int
+		if body.Host != "" {
+			if leaf := certCache.Lookup(body.Host); leaf != nil {
+				serial = leaf.SerialNumber
+			}
+		} else if body.Serial != "" {
+			serial, _ = new(big.Int).SetString(strings.TrimPrefix(body.Serial, "0x"), 16)
+		}
+		if serial == nil {
+			http.Error(w, "Unknown host or serial", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(revocations.Revoke(serial, body.Host, body.Reason))
+	case http.MethodDelete:
+		if !revocations.Unrevoke(r.URL.Query().Get("serial")) {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ============================================================================
+// CERTIFICATE TRANSPARENCY SIMULATION
+// ============================================================================
+
+const (
+	ctValid     = "valid"
+	ctInvalid   = "invalid"
+	ctMalformed = "malformed"
+	ctMissing   = "missing"
+)
+
+var (
+	oidSCTList  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+)
+
+// hostPatternSetting is one "pattern = value" line from a per-host INI
+// section. Lists of them are evaluated in file order, first match wins.
+type hostPatternSetting struct {
+	Pattern string
+	Value   string
+}
+
+// matchHostPattern matches hostname against an exact name, "*" or a
+// "*.example.com" wildcard, which also matches example.com itself.
+func matchHostPattern(pattern, hostname string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	hostname = strings.ToLower(hostname)
+
+	if pattern == "*" || pattern == hostname {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(hostname, pattern[1:]) || hostname == pattern[2:]
+	}
+	return false
+}
+
+func lookupHostSetting(settings []hostPatternSetting, hostname, fallback string) string {
+	for _, setting := range settings {
+		if matchHostPattern(setting.Pattern, hostname) {
+			return setting.Value
+		}
+	}
+	return fallback
+}
+
+// FakeCTLog stands in for a public CT log. Its key is kept in the cert
+// directory so the log ID stays stable and can be added to a client's log
+// list.
+type FakeCTLog struct {
+	Name string
+	key  *ecdsa.PrivateKey
+	id   [32]byte
+}
+
+var ctLogs []*FakeCTLog
+
+func loadFakeCTLogs(certDir string, count int) ([]*FakeCTLog, error) {
+	logs := make([]*FakeCTLog, 0, count)
+	for i := 1; i <= count; i++ {
+		keyPath := filepath.Join(certDir, fmt.Sprintf("ct-log-%d.key", i))
+
+		var key *ecdsa.PrivateKey
+		if fileExists(keyPath) {
+			signer, err := loadKeyPEM(keyPath)
+			if err != nil {
+				return nil, err
+			}
+			ecKey, ok := signer.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an ECDSA key", keyPath)
+			}
+			key = ecKey
+		} else {
+			var err error
+			if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+				return nil, err
+			}
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+				return nil, err
+			}
+		}
+
+		spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, &FakeCTLog{
+			Name: fmt.Sprintf("TLS Proxy Fake Log %d", i),
+			key:  key,
+			id:   sha256.Sum256(spki),
+		})
+	}
+
+	log.Printf("[CT] Loaded %d fake CT log(s)", len(logs))
+	return logs, nil
+}
+
+// Sign issues an SCT for an RFC 6962 entry: entryType 0 is an X.509 leaf,
+// 1 a precertificate. The returned bytes are one serialized SCT.
+func (l *FakeCTLog) Sign(entryType uint16, issuerKeyHash []byte, certData []byte, timestamp uint64) ([]byte, error) {
+	var signed bytes.Buffer
+	signed.WriteByte(0) // sct_version v1
+	signed.WriteByte(0) // signature_type certificate_timestamp
+	binary.Write(&signed, binary.BigEndian, timestamp)
+	binary.Write(&signed, binary.BigEndian, entryType)
+	if entryType == 1 {
+		signed.Write(issuerKeyHash)
+	}
+	signed.Write([]byte{byte(len(certData) >> 16), byte(len(certData) >> 8), byte(len(certData))})
+	signed.Write(certData)
+	signed.Write([]byte{0, 0}) // no extensions
+
+	digest := sha256.Sum256(signed.Bytes())
+	signature, err := ecdsa.SignASN1(rand.Reader, l.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var sct bytes.Buffer
+	sct.WriteByte(0)
+	sct.Write(l.id[:])
+	binary.Write(&sct, binary.BigEndian, timestamp)
+	sct.Write([]byte{0, 0})
+	sct.WriteByte(4) // sha256
+	sct.WriteByte(3) // ecdsa
+	binary.Write(&sct, binary.BigEndian, uint16(len(signature)))
+	sct.Write(signature)
+	return sct.Bytes(), nil
+}
+
+// sctListExtension builds the embedded SCT list extension for a precert TBS
+// in the requested mode.
+func sctListExtension(tbs []byte, issuer *x509.Certificate, mode string) (pkix.Extension, error) {
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	// Backdated slightly: clients reject SCTs from the future, and the leaf
+	// is often minted mid-handshake after the client took its timestamp
+	timestamp := uint64(time.Now().Add(-time.Minute).UnixMilli())
+
+	var list bytes.Buffer
+	for _, ctLog := range ctLogs {
+		sct, err := ctLog.Sign(1, issuerKeyHash[:], tbs, timestamp)
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		if mode == ctInvalid {
+			// Well-formed, but the signature no longer covers this certificate
+			sct[len(sct)-1] ^= 0xff
+		}
+		binary.Write(&list, binary.BigEndian, uint16(len(sct)))
+		list.Write(sct)
+	}
+
+	serialized := make([]byte, 2, 2+list.Len())
+	binary.BigEndian.PutUint16(serialized, uint16(list.Len()))
+	serialized = append(serialized, list.Bytes()...)
+
+	if mode == ctMalformed {
+		// Claim more data than is present and cut the last SCT short
+		binary.BigEndian.PutUint16(serialized, uint16(list.Len()+16))
+		serialized = serialized[:len(serialized)-8]
+	}
+
+	value, err := asn1.Marshal(serialized)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSCTList, Value: value}, nil
+}
+
+func ctModeFor(hostname string) string {
+	if !currentConfig().CTEnabled || len(ctLogs) == 0 {
+		return ctMissing
+	}
+	return lookupHostSetting(currentConfig().CTHostModes, hostname, currentConfig().CTDefaultMode)
+}
+
+// addEmbeddedSCTs signs the template once without SCTs to obtain the
+// precertificate TBS, then attaches SCTs over it. The final certificate must
+// be created from the same template and key so only the SCT list differs.
+func addEmbeddedSCTs(template *x509.Certificate, pub crypto.PublicKey, mode string, signer leafSigner) error {
+	precertDER, err := x509.CreateCertificate(rand.Reader, template, signer.cert, pub, signer.key)
+	if err != nil {
+		return err
+	}
+	precert, err := x509.ParseCertificate(precertDER)
+	if err != nil {
+		return err
+	}
+
+	ext, err := sctListExtension(precert.RawTBSCertificate, signer.cert, mode)
+	if err != nil {
+		return err
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	return nil
+}
+
+// removeTBSExtension strips one extension from a DER TBSCertificate, which is
+// how a log turns a submitted precertificate into the data it signs.
+func removeTBSExtension(tbs []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+	var fields []asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &fields); err != nil {
+		return nil, err
+	}
+
+	last := &fields[len(fields)-1]
+	if last.Class != asn1.ClassContextSpecific || last.Tag != 3 {
+		return tbs, nil
+	}
+
+	var exts []pkix.Extension
+	if _, err := asn1.Unmarshal(last.Bytes, &exts); err != nil {
+		return nil, err
+	}
+	kept := exts[:0]
+	for _, ext := range exts {
+		if !ext.Id.Equal(oid) {
+			kept = append(kept, ext)
+		}
+	}
+
+	extsDER, err := asn1.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	*last = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extsDER}
+
+	var body []byte
+	for _, field := range fields {
+		der, err := asn1.Marshal(field)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, der...)
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: body})
+}
+
+// handleCTAddChain implements RFC 6962 add-chain and add-pre-chain against
+// the first fake log, so tooling can obtain SCTs for arbitrary chains.
+func handleCTAddChain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(ctLogs) == 0 {
+		http.Error(w, "Certificate Transparency simulation is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var body struct {
+		Chain [][]byte `json:"chain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Chain) == 0 {
+		http.Error(w, "Invalid chain", http.StatusBadRequest)
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(body.Chain[0])
+	if err != nil {
+		http.Error(w, "Invalid leaf certificate", http.StatusBadRequest)
+		return
+	}
+
+	var entryType uint16
+	var issuerKeyHash [32]byte
+	certData := leaf.Raw
+
+	if strings.HasSuffix(r.URL.Path, "add-pre-chain") {
+		if len(body.Chain) < 2 {
+			http.Error(w, "Precertificate chain needs the issuer", http.StatusBadRequest)
+			return
+		}
+		issuer, err := x509.ParseCertificate(body.Chain[1])
+		if err != nil {
+			http.Error(w, "Invalid issuer certificate", http.StatusBadRequest)
+			return
+		}
+		if certData, err = removeTBSExtension(leaf.RawTBSCertificate, oidCTPoison); err != nil {
+			http.Error(w, "Invalid precertificate", http.StatusBadRequest)
+			return
+		}
+		entryType = 1
+		issuerKeyHash = sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	}
+
+	ctLog := ctLogs[0]
+	timestamp := uint64(time.Now().UnixMilli())
+	sct, err := ctLog.Sign(entryType, issuerKeyHash[:], certData, timestamp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The digitally-signed struct follows version, log ID, timestamp and
+	// the empty extensions
+	signatureOffset := 1 + 32 + 8 + 2
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sct_version": 0,
+		"id":          ctLog.id[:],
+		"timestamp":   timestamp,
+		"extensions":  "",
+		"signature":   sct[signatureOffset:],
+	})
+}
+
+func handleAPICT(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	w.Header().Set("Content-Type", "application/json")
+
+	logs := make([]map[string]interface{}, 0, len(ctLogs))
+	for _, ctLog := range ctLogs {
+		spki, _ := x509.MarshalPKIXPublicKey(&ctLog.key.PublicKey)
+		logs = append(logs, map[string]interface{}{
+			"description": ctLog.Name,
+			"log_id":      base64.StdEncoding.EncodeToString(ctLog.id[:]),
+			"key":         base64.StdEncoding.EncodeToString(spki),
+		})
+	}
+
+	hosts := make([]map[string]string, 0, len(cfg.CTHostModes))
+	for _, setting := range cfg.CTHostModes {
+		hosts = append(hosts, map[string]string{"pattern": setting.Pattern, "mode": setting.Value})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":     cfg.CTEnabled,
+		"defaultMode": cfg.CTDefaultMode,
+		"hosts":       hosts,
+		"logs":        logs,
+	})
+}
+
+// ============================================================================
+// NEGATIVE-TESTING CERTIFICATE FAULTS
+// ============================================================================
+
+const (
+	faultExpired         = "expired"
+	faultNotYetValid     = "not_yet_valid"
+	faultWrongHostname   = "wrong_hostname"
+	faultSelfSigned      = "self_signed"
+	faultMissingSAN      = "missing_san"
+	faultWeakKey         = "weak_key"
+	faultSHA1            = "sha1"
+	faultWrongEKU        = "wrong_eku"
+	faultUntrustedIssuer = "untrusted_issuer"
+	faultIncompleteChain = "incomplete_chain"
+)
+
+var knownCertFaults = []string{
+	faultExpired, faultNotYetValid, faultWrongHostname, faultSelfSigned, faultMissingSAN,
+	faultWeakKey, faultSHA1, faultWrongEKU, faultUntrustedIssuer, faultIncompleteChain,
+}
+
+// certFaultsFor returns the faults configured in [cert_faults] for hostname.
+// A pattern may list several faults separated by commas.
+func certFaultsFor(hostname string) []string {
+	value := lookupHostSetting(currentConfig().CertFaults, hostname, "")
+
+	var faults []string
+	for _, fault := range strings.Split(value, ",") {
+		fault = strings.ToLower(strings.TrimSpace(fault))
+		if fault != "" && fault != "none" {
+			faults = append(faults, fault)
+		}
+	}
+	return faults
+}
+
+func hasFault(faults []string, fault string) bool {
+	for _, f := range faults {
+		if f == fault {
+			return true
+		}
+	}
+	return false
+}
+
+// leafSigner is who signs a leaf and what is served after it.
+type leafSigner struct {
+	cert  *x509.Certificate
+	key   crypto.Signer
+	chain [][]byte
+}
+
+// applyCertFaults breaks the template in the configured ways and returns the
+// signer to use. Faults about the issuer (self-signed, untrusted, incomplete
+// chain) are expressed through the returned signer.
+func applyCertFaults(template *x509.Certificate, hostname string, faults []string, leafKey crypto.Signer) leafSigner {
+	ca := currentCA()
+	signer := leafSigner{cert: ca.cert, key: ca.key, chain: ca.chainDER()}
+	now := time.Now()
+
+	for _, fault := range faults {
+		switch fault {
+		case faultExpired:
+			template.NotBefore = now.AddDate(0, 0, -30)
+			template.NotAfter = now.AddDate(0, 0, -1)
+		case faultNotYetValid:
+			template.NotBefore = now.AddDate(0, 0, 30)
+			template.NotAfter = now.AddDate(0, 0, 60)
+		case faultWrongHostname:
+			template.RawSubject = nil
+			template.Subject.CommonName = "wrong-host.invalid"
+			template.DNSNames = []string{"wrong-host.invalid"}
+			template.IPAddresses = nil
+		case faultMissingSAN:
+			template.RawSubject = nil
+			template.Subject.CommonName = hostname
+			template.DNSNames = nil
+			template.IPAddresses = nil
+			template.EmailAddresses = nil
+			template.URIs = nil
+		case faultWrongEKU:
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+			template.UnknownExtKeyUsage = nil
+		case faultSelfSigned:
+			signer = leafSigner{cert: template, key: leafKey}
+		case faultUntrustedIssuer:
+			cert, key, err := untrustedIssuer()
+			if err != nil {
+				log.Printf("[FAULT] Failed to create untrusted issuer: %v", err)
+				continue
+			}
+			signer = leafSigner{cert: cert, key: key, chain: [][]byte{cert.Raw}}
+		case faultIncompleteChain:
+			// Only the leaf is sent. This breaks validation when leaves are
+			// signed by an intermediate the client doesn't already have.
+			signer.chain = nil
+		}
+	}
+
+	if hasFault(faults, faultSHA1) {
+		if _, ok := signer.key.Public().(*ecdsa.PublicKey); ok {
+			template.SignatureAlgorithm = x509.ECDSAWithSHA1
+		} else {
+			template.SignatureAlgorithm = x509.SHA1WithRSA
+		}
+	}
+
+	return signer
+}
+
+var (
+	untrustedOnce sync.Once
+	untrustedCert *x509.Certificate
+	untrustedKey  *rsa.PrivateKey
+	untrustedErr  error
+)
+
+// untrustedIssuer is a throwaway CA that exists only in memory, so no client
+// can possibly trust it.
+func untrustedIssuer() (*x509.Certificate, *rsa.PrivateKey, error) {
+	untrustedOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			untrustedErr = err
+			return
+		}
+		serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		template := &x509.Certificate{
+			SerialNumber: serialNumber,
+			Subject: pkix.Name{
+				Organization: []string{currentConfig().Organization},
+				CommonName:   "Untrusted Test CA",
+			},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().AddDate(1, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			untrustedErr = err
+			return
+		}
+		untrustedCert, untrustedErr = x509.ParseCertificate(der)
+		untrustedKey = key
+	})
+	return untrustedCert, untrustedKey, untrustedErr
+}
+
+// CertFaultResult records how a client reacted to a deliberately broken
+// certificate: accepted means it went on to send a request.
+type CertFaultResult struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Host       string    `json:"host"`
+	ClientAddr string    `json:"clientAddr"`
+	Faults     []string  `json:"faults"`
+	Accepted   bool      `json:"accepted"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+type CertFaultLog struct {
+	sync.RWMutex
+	results    []CertFaultResult
+	maxEntries int
+}
+
+var certFaultLog = &CertFaultLog{maxEntries: 1000}
+
+func (l *CertFaultLog) Record(host, clientAddr string, faults []string, accepted bool, detail string) {
+	outcome := "REJECTED"
+	if accepted {
+		outcome = "ACCEPTED"
+	}
+	log.Printf("[FAULT] %s %s certificate for %s (%s)", clientAddr, outcome, host, strings.Join(faults, ","))
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.results = append(l.results, CertFaultResult{
+		Timestamp:  time.Now(),
+		Host:       host,
+		ClientAddr: clientAddr,
+		Faults:     faults,
+		Accepted:   accepted,
+		Detail:     detail,
+	})
+	if len(l.results) > l.maxEntries {
+		l.results = l.results[len(l.results)-l.maxEntries:]
+	}
+}
+
+func (l *CertFaultLog) Results() []CertFaultResult {
+	l.RLock()
+	defer l.RUnlock()
+	return append([]CertFaultResult{}, l.results...)
+}
+
+func handleAPICertFaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodDelete {
+		certFaultLog.Lock()
+		certFaultLog.results = nil
+		certFaultLog.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(certFaultLog.Results())
+}
+
+// ============================================================================
+// CONFIGURATION RELOAD
+// ============================================================================
+
+const configWatchInterval = 2 * time.Second
+
+// Reloads re-read the same file chosen at startup; flags and environment
+// keep their precedence.
+var (
+	configFilePath     string
+	configFileExplicit bool
+
+	reloadMu   sync.Mutex
+	lastReload ReloadStatus
+)
+
+type ReloadStatus struct {
+	Time            time.Time `json:"time"`
+	Trigger         string    `json:"trigger"`
+	OK              bool      `json:"ok"`
+	Error           string    `json:"error,omitempty"`
+	Changed         []string  `json:"changed,omitempty"`
+	RestartRequired []string  `json:"restartRequired,omitempty"`
+}
+
+// restartOnlySettings are consumed once at startup (listeners, CA, key pool,
+// disk cache). Changes are reported and the running value is kept. Every
+// [ca_certificate] key is restart-only as well.
+var restartOnlySettings = map[string]bool{
+	"server.port":                     true,
+	"server.monitor_port":             true,
+	"server.cert_dir":                 true,
+	"server.skip_install":             true,
+	"server.watch_config":             true,
+	"server.bind":                     true,
+	"server.monitor_bind":             true,
+	"revocation.enabled":              true,
+	"revocation.listen":               true,
+	"ct.enabled":                      true,
+	"ct.log_count":                    true,
+	"host_certificates.key_pool_size": true,
+	"host_certificates.disk_cache":    true,
+}
+
+// leafSections hold settings baked into host certificates; changing them
+// flushes the leaf cache so new handshakes pick them up.
+var leafSections = []string{"certificate_extensions", "host_certificates", "revocation", "ct", "ct_hosts", "cert_faults"}
+
+func isRestartOnly(name string) bool {
+	return restartOnlySettings[name] || strings.HasPrefix(name, "ca_certificate.")
+}
+
+// diffConfig lists the settings (section.key, or the section name for
+// pattern sections) that differ between two configurations.
+func diffConfig(old, new *CertConfig) []string {
+	var changed []string
+	for _, s := range configSettings {
+		if s.get(old) != s.get(new) {
+			changed = append(changed, s.name())
+		}
+	}
+	if fmt.Sprint(old.CTHostModes) != fmt.Sprint(new.CTHostModes) {
+		changed = append(changed, "ct_hosts")
+	}
+	if fmt.Sprint(old.CertFaults) != fmt.Sprint(new.CertFaults) {
+		changed = append(changed, "cert_faults")
+	}
+	if fmt.Sprint(old.DNSHosts) != fmt.Sprint(new.DNSHosts) {
+		changed = append(changed, "dns_hosts")
+	}
+	if moduleSignature(old.Modules) != moduleSignature(new.Modules) {
+		changed = append(changed, "module")
+	}
+	return changed
+}
+
+// reloadConfig rebuilds the configuration and module chain and swaps them in
+// together. Connections already open keep their certificates; requests
+// started after the swap see the new settings. An invalid configuration is
+// rejected and the running one stays in place.
+func reloadConfig(trigger string) ReloadStatus {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	status := ReloadStatus{Time: time.Now(), Trigger: trigger}
+
+	cfg, _, err := buildConfig(configFilePath, configFileExplicit)
+	if err != nil {
+		status.Error = err.Error()
+		log.Printf("[RELOAD] Rejected configuration (%s), keeping the running one:\n%v", trigger, err)
+		lastReload = status
+		return status
+	}
+
+	old := currentConfig()
+	flush := false
+	for _, name := range diffConfig(old, cfg) {
+		if isRestartOnly(name) {
+			setting, _ := findConfigSetting(name)
+			setting.set(cfg, setting.get(old))
+			status.RestartRequired = append(status.RestartRequired, name)
+			continue
+		}
+		status.Changed = append(status.Changed, name)
+		section, _, _ := strings.Cut(name, ".")
+		flush = flush || slices.Contains(leafSections, section)
+	}
+
+	activeConfig.Store(cfg)
+	initializeModules()
+
+	certCache.Lock()
+	certCache.maxEntries = cfg.CacheMaxEntries
+	certCache.Unlock()
+	if flush {
+		certCache.Flush()
+	}
+
+	status.OK = true
+	lastReload = status
+
+	log.Printf("[RELOAD] Configuration reloaded (%s): %d setting(s) changed", trigger, len(status.Changed))
+	for _, name := range status.Changed {
+		log.Printf("[RELOAD]   %s", name)
+	}
+	if flush {
+		log.Println("[RELOAD] Host certificate cache flushed")
+	}
+	for _, name := range status.RestartRequired {
+		log.Printf("[RELOAD] WARNING: %s changed but only takes effect after a restart", name)
+	}
+	return status
+}
+
+// watchConfigFile polls the config file and reloads once a change has
+// settled for one interval, so a half-written file isn't picked up.
+func watchConfigFile(path string) {
+	stamp := func() string {
+		info, err := os.Stat(path)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	}
+
+	last := stamp()
+	pending := false
+	for range time.Tick(configWatchInterval) {
+		current := stamp()
+		switch {
+		case current != last:
+			last = current
+			pending = true
+		case pending:
+			pending = false
+			reloadConfig("file change")
+		}
+	}
+}
+
+func handleReloadSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloadConfig("SIGHUP")
+	}
+}
+
+// handleAPIReload reloads on POST and reports the last reload on GET.
+func handleAPIReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		reloadMu.Lock()
+		status := lastReload
+		reloadMu.Unlock()
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if !mutationAllowed(w, r) {
+		return
+	}
+
+	status := reloadConfig("api")
+	if !status.OK {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// ============================================================================
+// CA LIFECYCLE COMMANDS
+// ============================================================================
+
+const javaKeystorePassword = "changeit"
+
+// runCACommand implements "tlsproxy [flags] ca <command>".
+func runCACommand(config *ProxyConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: tlsproxy [flags] ca show|rotate|export|status|install|uninstall")
+	}
+
+	switch args[0] {
+	case "show":
+		return caShow(config)
+	case "rotate":
+		return caRotate(config)
+	case "export":
+		return caExport(config, args[1:])
+	case "status":
+		return caStatus(config)
+	case "install":
+		return withRootCertFile(config, installCertificate)
+	case "uninstall":
+		return withRootCertFile(config, uninstallCertificate)
+	}
+	return fmt.Errorf("unknown ca command %q (expected show, rotate, export, status, install or uninstall)", args[0])
+}
+
+// withRootCertFile calls fn with a PEM file holding the trust anchor. An
+// imported CA has no proxy-ca.crt, so its root is written to a temp file.
+func withRootCertFile(config *ProxyConfig, fn func(certPath string) error) error {
+	if err := loadExistingCA(config); err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(config.CertDir, caCertFile)
+	if cert, err := loadCertPEM(certPath); err == nil && cert.Equal(caRootCert()) {
+		return fn(certPath)
+	}
+
+	tmp, err := os.CreateTemp("", "tlsproxy-ca-*.crt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: caRootCert().Raw})
+	tmp.Close()
+	return fn(tmp.Name())
+}
+
+// loadExistingCA reads the configured CA for the ca commands. Unlike
+// initCA it never generates, re-issues or installs anything. A missing key
+// (a root kept offline) only fails the commands that need it.
+func loadExistingCA(config *ProxyConfig) error {
+	if currentConfig().ImportP12 != "" || currentConfig().ImportCert != "" {
+		return importCA()
+	}
+
+	certPath := filepath.Join(config.CertDir, caCertFile)
+	if !fileExists(certPath) {
+		return fmt.Errorf("no CA found in %s - run the proxy once to generate one", config.CertDir)
+	}
+	root, err := loadCertPEM(certPath)
+	if err != nil {
+		return err
+	}
+
+	if currentConfig().UseIntermediate {
+		intCertPath := filepath.Join(config.CertDir, intermediateCertFile)
+		if fileExists(intCertPath) {
+			cert, err := loadCertPEM(intCertPath)
+			if err != nil {
+				return err
+			}
+			key, err := loadKeyIfPresent(filepath.Join(config.CertDir, intermediateKeyFile))
+			if err != nil {
+				return err
+			}
+			setCA(cert, key, []*x509.Certificate{cert, root})
+			return nil
+		}
+		log.Println("No intermediate CA issued yet - using the root")
+	}
+
+	key, err := loadKeyIfPresent(filepath.Join(config.CertDir, caKeyFile))
+	if err != nil {
+		return err
+	}
+	setCA(root, key, []*x509.Certificate{root})
+	return nil
+}
+
+// loadKeyIfPresent is loadKeyPEM that returns a nil key for a missing file.
+func loadKeyIfPresent(path string) (crypto.Signer, error) {
+	if !fileExists(path) {
+		return nil, nil
+	}
+	return loadKeyPEM(path)
+}
+
+func caShow(config *ProxyConfig) error {
+	if err := loadExistingCA(config); err != nil {
+		return err
+	}
+
+	chain := currentCA().chain
+	for i, cert := range chain {
+		if i > 0 {
+			fmt.Println()
+		}
+		switch {
+		case len(chain) == 1:
+			fmt.Println("=== CA Certificate ===")
+		case i == 0:
+			fmt.Println("=== Signing CA (issues host certificates) ===")
+		case i == len(chain)-1:
+			fmt.Println("=== Root CA (trust anchor) ===")
+		default:
+			fmt.Println("=== Intermediate CA ===")
+		}
+		printCertDetails(cert)
+	}
+	return nil
+}
+
+func printCertDetails(cert *x509.Certificate) {
+	remaining := time.Until(cert.NotAfter)
+	validity := fmt.Sprintf("%d days remaining", int(remaining.Hours()/24))
+	if remaining < 0 {
+		validity = "EXPIRED"
+	}
+
+	fmt.Printf("Subject:            %s\n", cert.Subject)
+	fmt.Printf("Issuer:             %s\n", cert.Issuer)
+	fmt.Printf("Serial:             %s\n", formatFingerprint(cert.SerialNumber.Bytes()))
+	fmt.Printf("Valid from:         %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("Valid until:        %s (%s)\n", cert.NotAfter.Format(time.RFC3339), validity)
+	fmt.Printf("Public key:         %s\n", describePublicKey(cert.PublicKey))
+	fmt.Printf("Signature:          %s\n", cert.SignatureAlgorithm)
+	fmt.Printf("SHA-256:            %s\n", certFingerprintColons(cert, crypto.SHA256))
+	fmt.Printf("SHA-1:              %s\n", certFingerprintColons(cert, crypto.SHA1))
+
+	if cert.BasicConstraintsValid {
+		pathLen := "unlimited"
+		if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+			pathLen = fmt.Sprintf("%d", cert.MaxPathLen)
+		}
+		fmt.Printf("Basic constraints:  CA=%t, max path length %s\n", cert.IsCA, pathLen)
+	}
+	if usages := keyUsageNames(cert.KeyUsage); len(usages) > 0 {
+		fmt.Printf("Key usage:          %s\n", strings.Join(usages, ", "))
+	}
+	if usages := extKeyUsageNames(cert.ExtKeyUsage); len(usages) > 0 {
+		fmt.Printf("Extended key usage: %s\n", strings.Join(usages, ", "))
+	}
+	if len(cert.SubjectKeyId) > 0 {
+		fmt.Printf("Subject key ID:     %s\n", formatFingerprint(cert.SubjectKeyId))
+	}
+	if len(cert.AuthorityKeyId) > 0 {
+		fmt.Printf("Authority key ID:   %s\n", formatFingerprint(cert.AuthorityKeyId))
+	}
+	if len(cert.CRLDistributionPoints) > 0 {
+		fmt.Printf("CRL distribution:   %s\n", strings.Join(cert.CRLDistributionPoints, ", "))
+	}
+	if len(cert.OCSPServer) > 0 {
+		fmt.Printf("OCSP:               %s\n", strings.Join(cert.OCSPServer, ", "))
+	}
+	if len(cert.IssuingCertificateURL) > 0 {
+		fmt.Printf("CA issuers:         %s\n", strings.Join(cert.IssuingCertificateURL, ", "))
+	}
+}
+
+func describePublicKey(pub crypto.PublicKey) string {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+func keyUsageNames(usage x509.KeyUsage) []string {
+	names := []struct {
+		bit  x509.KeyUsage
+		name string
+	}{
+		{x509.KeyUsageDigitalSignature, "Digital Signature"},
+		{x509.KeyUsageContentCommitment, "Content Commitment"},
+		{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+		{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+		{x509.KeyUsageKeyAgreement, "Key Agreement"},
+		{x509.KeyUsageCertSign, "Certificate Sign"},
+		{x509.KeyUsageCRLSign, "CRL Sign"},
+	}
+
+	var result []string
+	for _, n := range names {
+		if usage&n.bit != 0 {
+			result = append(result, n.name)
+		}
+	}
+	return result
+}
+
+func extKeyUsageNames(usages []x509.ExtKeyUsage) []string {
+	names := map[x509.ExtKeyUsage]string{
+		x509.ExtKeyUsageAny:             "Any",
+		x509.ExtKeyUsageServerAuth:      "Server Auth",
+		x509.ExtKeyUsageClientAuth:      "Client Auth",
+		x509.ExtKeyUsageCodeSigning:     "Code Signing",
+		x509.ExtKeyUsageEmailProtection: "Email Protection",
+		x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+		x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+	}
+
+	var result []string
+	for _, usage := range usages {
+		if name, ok := names[usage]; ok {
+			result = append(result, name)
+		} else {
+			result = append(result, fmt.Sprintf("EKU(%d)", usage))
+		}
+	}
+	return result
+}
+
+func certFingerprintColons(cert *x509.Certificate, hash crypto.Hash) string {
+	h := hash.New()
+	h.Write(cert.Raw)
+	return formatFingerprint(h.Sum(nil))
+}
+
+func formatFingerprint(b []byte) string {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(parts, ":")
+}
+
+// caRotate replaces the proxy CA: the old one is uninstalled and kept as
+// *.old, a new one is generated and installed, and every cached host
+// certificate is dropped since it chains to the old CA.
+func caRotate(config *ProxyConfig) error {
+	if currentConfig().ImportP12 != "" || currentConfig().ImportCert != "" {
+		return fmt.Errorf("the CA is imported from outside the proxy - rotate it there")
+	}
+
+	certPath := filepath.Join(config.CertDir, caCertFile)
+	keyPath := filepath.Join(config.CertDir, caKeyFile)
+
+	if fileExists(certPath) {
+		if old, err := loadCertPEM(certPath); err == nil {
+			log.Printf("Rotating CA %s (SHA-256 %s)", old.Subject.CommonName, certFingerprintColons(old, crypto.SHA256))
+		}
+
+		if !config.SkipInstall {
+			log.Println("Removing old CA from system trust store...")
+			if err := uninstallCertificate(certPath); err != nil {
+				log.Printf("WARNING: Failed to uninstall old certificate: %v", err)
+			}
+		}
+
+		for _, path := range []string{certPath, keyPath} {
+			if fileExists(path) {
+				if err := os.Rename(path, path+".old"); err != nil {
+					return err
+				}
+				log.Printf("Moved %s to %s.old", path, path)
+			}
+		}
+	}
+
+	for _, name := range []string{intermediateCertFile, intermediateKeyFile} {
+		os.Remove(filepath.Join(config.CertDir, name))
+	}
+
+	certCache.Flush()
+	if hostDir := filepath.Join(config.CertDir, hostCertDir); fileExists(hostDir) {
+		os.RemoveAll(hostDir)
+		log.Printf("Flushed host certificate cache: %s", hostDir)
+	}
+
+	if err := initCA(config); err != nil {
+		return err
+	}
+
+	log.Printf("New CA SHA-256: %s", certFingerprintColons(caRootCert(), crypto.SHA256))
+	log.Println("Restart any running proxy instance to pick up the new CA")
+	return nil
+}
+
+// caExport writes the trust anchor as DER or PEM, or the signing CA with its
+// key and chain as PKCS#12 for use in other interception tools.
+func caExport(config *ProxyConfig, args []string) error {
+	fs := flag.NewFlagSet("ca export", flag.ContinueOnError)
+	format := fs.String("format", "pem", "Export format: der, pem or p12")
+	out := fs.String("out", "", "Output file (default proxy-ca-export.<format>)")
+	password := fs.String("password", "", "PKCS#12 password (default $TLSPROXY_P12_PASSWORD)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadExistingCA(config); err != nil {
+		return err
+	}
+
+	*format = strings.ToLower(*format)
+	if *out == "" {
+		*out = "proxy-ca-export." + *format
+	}
+
+	root := caRootCert()
+	switch *format {
+	case "der":
+		if err := os.WriteFile(*out, root.Raw, 0644); err != nil {
+			return err
+		}
+	case "pem":
+		if err := os.WriteFile(*out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), 0644); err != nil {
+			return err
+		}
+	case "p12":
+		if err := exportPKCS12(*out, *password); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q (expected der, pem or p12)", *format)
+	}
+
+	log.Printf("Exported %s as %s: %s", root.Subject.CommonName, *format, *out)
+	return nil
+}
+
+func exportPKCS12(outPath, password string) error {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		return fmt.Errorf("openssl not found in PATH - required for PKCS#12 export")
+	}
+	if password == "" {
+		password = os.Getenv("TLSPROXY_P12_PASSWORD")
+	}
+	if password == "" {
+		return fmt.Errorf("PKCS#12 export needs --password or TLSPROXY_P12_PASSWORD")
+	}
+
+	ca := currentCA()
+	if ca.key == nil {
+		return fmt.Errorf("the CA private key is not available (kept offline?)")
+	}
+	keyBlock, err := marshalPrivateKeyPEM(ca.key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "tlsproxy-export-*.pem")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	pem.Encode(tmp, keyBlock)
+	for _, cert := range ca.chain {
+		pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	tmp.Close()
+
+	cmd := exec.Command("openssl", "pkcs12", "-export", "-in", tmp.Name(), "-out", outPath,
+		"-name", ca.cert.Subject.CommonName, "-passout", "env:TLSPROXY_P12_PASSWORD")
+	cmd.Env = append(os.Environ(), "TLSPROXY_P12_PASSWORD="+password)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("openssl pkcs12 failed: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func caStatus(config *ProxyConfig) error {
+	if err := loadExistingCA(config); err != nil {
+		return err
+	}
+
+	root := caRootCert()
+	fmt.Printf("CA:      %s\n", root.Subject)
+	fmt.Printf("SHA-256: %s\n\n", certFingerprintColons(root, crypto.SHA256))
+
+	for _, status := range checkTrustStores(root) {
+		result := "NOT TRUSTED"
+		switch {
+		case status.Err != nil:
+			result = "UNKNOWN"
+		case status.Present:
+			result = "TRUSTED"
+		}
+		fmt.Printf("  %-12s %-12s %s\n", status.Store, result, status.Location)
+		if status.Err != nil {
+			fmt.Printf("  %-12s %-12s (%v)\n", "", "", status.Err)
+		}
+	}
+
+	for _, record := range loadTrustRecords() {
+		if record.Fingerprint != certFingerprint(root) {
+			fmt.Printf("\nStill installed from an earlier CA: %s (%s)\n", record.Subject, record.Fingerprint)
+		} else {
+			fmt.Printf("\nInstalled by tlsproxy (%s):\n", trustRecordPath)
+		}
+		for _, entry := range record.Installed {
+			fmt.Printf("  %-12s %s %s\n", entry.Store, entry.Location, entry.Name)
+		}
+	}
+	return nil
+}
+
+// ============================================================================
+// TRUST STORE DISCOVERY
+// ============================================================================
+
+type trustStoreStatus struct {
+	Store    string
+	Location string
+	Present  bool
+	Err      error
+}
+
+func checkTrustStores(cert *x509.Certificate) []trustStoreStatus {
+	statuses := []trustStoreStatus{checkSystemTrustStore(cert)}
+	for _, db := range findNSSDatabases() {
+		statuses = append(statuses, checkNSSDatabase(db, cert))
+	}
+	for _, keystore := range javaKeystores() {
+		statuses = append(statuses, checkJavaKeystore(keystore, cert))
+	}
+	return statuses
+}
+
+func checkSystemTrustStore(cert *x509.Certificate) trustStoreStatus {
+	switch runtime.GOOS {
+	case "windows":
+		status := trustStoreStatus{Store: "Windows", Location: windowsRootStore}
+		status.Present, status.Err = windowsStoreContains(cert)
+		return status
+	case "darwin":
+		status := trustStoreStatus{Store: "macOS", Location: "Keychain search list"}
+		status.Present, status.Err = macKeychainContains(cert, "")
+		return status
+	default:
+		status := trustStoreStatus{Store: "System"}
+		for _, bundle := range []string{
+			"/etc/ssl/certs/ca-certificates.crt",
+			"/etc/pki/tls/certs/ca-bundle.crt",
+			"/etc/ssl/ca-bundle.pem",
+			"/etc/ssl/cert.pem",
+		} {
+			if !fileExists(bundle) {
+				continue
+			}
+			status.Location = bundle
+			certs, err := loadCertChainPEM(bundle)
+			if err != nil {
+				status.Err = err
+				return status
+			}
+			status.Present = containsCert(certs, cert)
+			return status
+		}
+		status.Err = fmt.Errorf("no system CA bundle found")
+		return status
+	}
+}
+
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+type nssDatabase struct {
+	Browser string
+	Dir     string
+}
+
+// findNSSDatabases looks for the NSS databases used by Chrome/Chromium on
+// Linux and by Firefox profiles on every platform.
+func findNSSDatabases() []nssDatabase {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	var dbs []nssDatabase
+	for _, dir := range []string{
+		filepath.Join(home, ".pki", "nssdb"),
+		filepath.Join(home, "snap", "chromium", "current", ".pki", "nssdb"),
+	} {
+		if fileExists(filepath.Join(dir, "cert9.db")) {
+			dbs = append(dbs, nssDatabase{Browser: "Chrome", Dir: dir})
+		}
+	}
+
+	profileRoots := []string{
+		filepath.Join(home, ".mozilla", "firefox"),
+		filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox"),
+		filepath.Join(home, ".var", "app", "org.mozilla.firefox", ".mozilla", "firefox"),
+		filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles"),
+	}
+	if appData := os.Getenv("APPDATA"); appData != "" {
+		profileRoots = append(profileRoots, filepath.Join(appData, "Mozilla", "Firefox", "Profiles"))
+	}
+	for _, root := range profileRoots {
+		matches, _ := filepath.Glob(filepath.Join(root, "*", "cert9.db"))
+		for _, match := range matches {
+			dbs = append(dbs, nssDatabase{Browser: "Firefox", Dir: filepath.Dir(match)})
+		}
+	}
+
+	return dbs
+}
+
+// nssCertutil returns the NSS certutil binary. On Windows "certutil" is the
+// unrelated Microsoft tool, so NSS databases are only handled elsewhere.
+func nssCertutil() (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("NSS certutil is not supported on Windows - import the CA through the browser")
+	}
+	path, err := exec.LookPath("certutil")
+	if err != nil {
+		return "", fmt.Errorf("NSS certutil not found (install libnss3-tools / nss-tools)")
+	}
+	return path, nil
+}
+
+func checkNSSDatabase(db nssDatabase, cert *x509.Certificate) trustStoreStatus {
+	status := trustStoreStatus{Store: db.Browser, Location: db.Dir}
+
+	certutil, err := nssCertutil()
+	if err != nil {
+		status.Err = err
+		return status
+	}
+
+	status.Present = len(nssNicknamesFor(certutil, db.Dir, cert)) > 0
+	return status
+}
+
+// nssNicknamesFor returns the nicknames under which the certificate is
+// stored, whatever they are called.
+func nssNicknamesFor(certutil, dir string, cert *x509.Certificate) []string {
+	var nicknames []string
+	for _, nickname := range listNSSNicknames(certutil, dir) {
+		output, err := exec.Command(certutil, "-L", "-d", "sql:"+dir, "-n", nickname, "-a").Output()
+		if err != nil {
+			continue
+		}
+		var certs []*x509.Certificate
+		for {
+			var block *pem.Block
+			block, output = pem.Decode(output)
+			if block == nil {
+				break
+			}
+			if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+				certs = append(certs, c)
+			}
+		}
+		if containsCert(certs, cert) {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return nicknames
+}
+
+// listNSSNicknames parses "certutil -L", whose rows are a nickname padded
+// with spaces followed by the trust flags.
+func listNSSNicknames(certutil, dir string) []string {
+	output, err := exec.Command(certutil, "-L", "-d", "sql:"+dir).Output()
+	if err != nil {
+		return nil
+	}
+
+	var nicknames []string
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimRight(line, " \r")
+		idx := strings.LastIndex(line, " ")
+		if idx <= 0 || !strings.Contains(line[idx+1:], ",") {
+			continue
+		}
+		if nickname := strings.TrimSpace(line[:idx]); nickname != "" {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return nicknames
+}
+
+// findJavaKeystores locates the cacerts of the JVM on JAVA_HOME or PATH,
+// plus the distro-managed Debian keystore.
+func findJavaKeystores() []string {
+	var homes []string
+	if javaHome := os.Getenv("JAVA_HOME"); javaHome != "" {
+		homes = append(homes, javaHome)
+	}
+	if javaBin, err := exec.LookPath("java"); err == nil {
+		if resolved, err := filepath.EvalSymlinks(javaBin); err == nil {
+			homes = append(homes, filepath.Dir(filepath.Dir(resolved)))
+		}
+	}
+
+	candidates := []string{"/etc/ssl/certs/java/cacerts"}
+	for _, home := range homes {
+		candidates = append(candidates,
+			filepath.Join(home, "lib", "security", "cacerts"),
+			filepath.Join(home, "jre", "lib", "security", "cacerts"))
+	}
+
+	seen := make(map[string]bool)
+	var keystores []string
+	for _, candidate := range candidates {
+		resolved, err := filepath.EvalSymlinks(candidate)
+		if err != nil || seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		keystores = append(keystores, resolved)
+	}
+	return keystores
+}
+
+func checkJavaKeystore(keystore string, cert *x509.Certificate) trustStoreStatus {
+	status := trustStoreStatus{Store: "Java", Location: keystore}
+
+	keytool, err := exec.LookPath("keytool")
+	if err != nil {
+		status.Err = fmt.Errorf("keytool not found in PATH")
+		return status
+	}
+
+	aliases, err := javaAliasesFor(keytool, keystore, cert)
+	status.Present, status.Err = len(aliases) > 0, err
+	return status
+}
+
+// ============================================================================
+// LINUX TRUST STORE LAYOUTS
+// ============================================================================
+
+// linuxTrustLayout describes where a distribution keeps locally added CA
+// anchors and how its bundle is regenerated. An empty AnchorDir means the
+// p11-kit "trust anchor" tool manages the file itself.
+type linuxTrustLayout struct {
+	Name      string
+	AnchorDir string
+	Refresh   []string
+}
+
+var linuxTrustLayouts = map[string]linuxTrustLayout{
+	"debian": {Name: "debian", AnchorDir: "/usr/local/share/ca-certificates", Refresh: []string{"update-ca-certificates"}},
+	"alpine": {Name: "alpine", AnchorDir: "/usr/local/share/ca-certificates", Refresh: []string{"update-ca-certificates"}},
+	"rhel":   {Name: "rhel", AnchorDir: "/etc/pki/ca-trust/source/anchors", Refresh: []string{"update-ca-trust", "extract"}},
+	"suse":   {Name: "suse", AnchorDir: "/etc/pki/trust/anchors", Refresh: []string{"update-ca-certificates"}},
+	"arch":   {Name: "arch"},
+}
+
+// linuxAnchorFile is the anchor name used by older versions and in the
+// manual instructions; installs now use linuxAnchorName.
+const linuxAnchorFile = "tlsproxy.crt"
+
+// detectLinuxTrustLayout honours linux_layout, then /etc/os-release, then
+// falls back to whichever trust tool is installed.
+func detectLinuxTrustLayout() (linuxTrustLayout, error) {
+	if name := currentConfig().LinuxTrustLayout; name != "" && name != "auto" {
+		layout, ok := linuxTrustLayouts[name]
+		if !ok {
+			return linuxTrustLayout{}, fmt.Errorf("unknown linux_layout %q (expected auto, debian, rhel, arch, alpine or suse)", name)
+		}
+		return layout, nil
+	}
+
+	for _, id := range osReleaseIDs() {
+		switch {
+		case id == "debian" || id == "ubuntu":
+			return linuxTrustLayouts["debian"], nil
+		case id == "rhel" || id == "fedora" || id == "centos":
+			return linuxTrustLayouts["rhel"], nil
+		case id == "arch":
+			return linuxTrustLayouts["arch"], nil
+		case id == "alpine":
+			return linuxTrustLayouts["alpine"], nil
+		case id == "suse" || id == "sles" || strings.HasPrefix(id, "opensuse"):
+			return linuxTrustLayouts["suse"], nil
+		}
+	}
+
+	switch {
+	case commandExists("update-ca-trust"):
+		return linuxTrustLayouts["rhel"], nil
+	case commandExists("trust"):
+		return linuxTrustLayouts["arch"], nil
+	case commandExists("update-ca-certificates") && fileExists("/etc/pki/trust"):
+		return linuxTrustLayouts["suse"], nil
+	case commandExists("update-ca-certificates"):
+		return linuxTrustLayouts["debian"], nil
+	}
+	return linuxTrustLayout{}, fmt.Errorf("could not detect the system trust store layout - set linux_layout in [trust_stores]")
+}
+
+// osReleaseIDs returns ID followed by the ID_LIKE entries of /etc/os-release.
+func osReleaseIDs() []string {
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return nil
+	}
+
+	var id, idLike []string
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.ToLower(strings.Trim(value, `"'`))
+		switch key {
+		case "ID":
+			id = []string{value}
+		case "ID_LIKE":
+			idLike = strings.Fields(value)
+		}
+	}
+	return append(id, idLike...)
+}
+
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// linuxAnchorName is the file name of the CA in the anchor directory.
+func linuxAnchorName(cert *x509.Certificate) string {
+	return trustAliasFor(cert) + ".crt"
+}
+
+func installSystemCertLinux(cert *x509.Certificate, certPath string) error {
+	if currentConfig().UserTrust {
+		log.Println("User scope: skipping the system trust store")
+		return nil
+	}
+
+	layout, err := detectLinuxTrustLayout()
+	if err != nil {
+		return err
+	}
+	log.Printf("Installing certificate into %s system trust store...", layout.Name)
+
+	entry := trustInstallEntry{Store: trustStoreSystem, Name: layout.Name}
+	if layout.AnchorDir == "" {
+		if err := runTrustCommandChecked(true, "trust", "anchor", "--store", certPath); err != nil {
+			return err
+		}
+		entry.Location = p11KitLocation
+		recordTrustInstall(cert, entry)
+	} else {
+		entry.Location = filepath.Join(layout.AnchorDir, linuxAnchorName(cert))
+		if err := runTrustCommandChecked(true, "install", "-D", "-m", "0644", certPath, entry.Location); err != nil {
+			return fmt.Errorf("failed to copy certificate: %v", err)
+		}
+		recordTrustInstall(cert, entry)
+
+		if err := runTrustCommandChecked(true, layout.Refresh[0], layout.Refresh[1:]...); err != nil {
+			return err
+		}
+	}
+
+	if !currentConfig().TrustDryRun {
+		if status := checkSystemTrustStore(cert); !status.Present {
+			log.Printf("WARNING: CA not found in %s after install", status.Location)
+		}
+	}
+	return nil
+}
+
+// findLinuxSystemEntries also matches the fixed tlsproxy.crt name used by
+// older versions, but only when that file holds this exact CA.
+func findLinuxSystemEntries(cert *x509.Certificate) []trustInstallEntry {
+	if currentConfig().UserTrust {
+		return nil
+	}
+
+	layout, err := detectLinuxTrustLayout()
+	if err != nil {
+		return nil
+	}
+
+	if layout.AnchorDir == "" {
+		if checkSystemTrustStore(cert).Present {
+			return []trustInstallEntry{{Store: trustStoreSystem, Location: p11KitLocation, Name: layout.Name}}
+		}
+		return nil
+	}
+
+	var entries []trustInstallEntry
+	for _, name := range []string{linuxAnchorName(cert), linuxAnchorFile} {
+		path := filepath.Join(layout.AnchorDir, name)
+		if anchor, err := loadCertPEM(path); err == nil && anchor.Equal(cert) {
+			entries = append(entries, trustInstallEntry{Store: trustStoreSystem, Location: path, Name: layout.Name})
+		}
+	}
+	return entries
+}
+
+// runTrustCommand runs a command that changes a trust store, or only prints
+// it when dry_run is set. Privileged commands go through sudo unless the
+// proxy already runs as root.
+func runTrustCommand(privileged bool, name string, args ...string) ([]byte, error) {
+	if privileged && os.Geteuid() != 0 {
+		args = append([]string{name}, args...)
+		name = "sudo"
+	}
+
+	if currentConfig().TrustDryRun {
+		log.Printf("[dry-run] %s", shellQuoteCommand(name, args))
+		return nil, nil
+	}
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func runTrustCommandChecked(privileged bool, name string, args ...string) error {
+	output, err := runTrustCommand(privileged, name, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %v - %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func shellQuoteCommand(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t'\"$\\*?;&|<>()") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// ============================================================================
+// BROWSER AND JAVA TRUST STORES
+// ============================================================================
+
+// installExtraTrustStores adds the CA to the NSS databases of Chrome and
+// Firefox and, when enabled, to JVM cacerts. Failures are logged but do not
+// fail the install - the system trust store is what matters most.
+func installExtraTrustStores(cert *x509.Certificate, certPath string) {
+	if currentConfig().InstallNSS {
+		if err := installNSSDatabases(cert, certPath); err != nil {
+			log.Printf("WARNING: NSS install: %v", err)
+		}
+	}
+	if currentConfig().InstallJava {
+		if err := installJavaKeystores(cert, certPath); err != nil {
+			log.Printf("WARNING: Java keystore install: %v", err)
+		}
+	}
+}
+
+func installNSSDatabases(cert *x509.Certificate, certPath string) error {
+	certutil, err := nssCertutil()
+	if err != nil {
+		if len(findNSSDatabases()) == 0 {
+			return nil
+		}
+		return err
+	}
+
+	// Chrome only creates its database on first start; create it so the CA
+	// is already trusted when it does.
+	if home, err := os.UserHomeDir(); err == nil {
+		chromeDB := filepath.Join(home, ".pki", "nssdb")
+		if !fileExists(filepath.Join(chromeDB, "cert9.db")) {
+			os.MkdirAll(chromeDB, 0700)
+			output, err := runTrustCommand(false, certutil, "-N", "-d", "sql:"+chromeDB, "--empty-password")
+			if err != nil {
+				log.Printf("WARNING: Could not create %s: %v - %s", chromeDB, err, strings.TrimSpace(string(output)))
+			}
+		}
+	}
+
+	nickname := trustAliasFor(cert)
+	var failed []string
+	for _, db := range findNSSDatabases() {
+		output, err := runTrustCommand(false, certutil, "-A", "-d", "sql:"+db.Dir, "-n", nickname,
+			"-t", "C,,", "-i", certPath)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v - %s", db.Dir, err, strings.TrimSpace(string(output))))
+			continue
+		}
+		if currentConfig().TrustDryRun {
+			continue
+		}
+		if len(nssNicknamesFor(certutil, db.Dir, cert)) == 0 {
+			failed = append(failed, fmt.Sprintf("%s: CA not found after install", db.Dir))
+			continue
+		}
+		recordTrustInstall(cert, trustInstallEntry{Store: trustStoreNSS, Location: db.Dir, Name: nickname})
+		log.Printf("Certificate installed in %s NSS database: %s", db.Browser, db.Dir)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// javaKeystores returns the configured keystore, or every discovered one.
+func javaKeystores() []string {
+	if currentConfig().JavaKeystore != "" {
+		return []string{currentConfig().JavaKeystore}
+	}
+	return findJavaKeystores()
+}
+
+func installJavaKeystores(cert *x509.Certificate, certPath string) error {
+	keytool, err := exec.LookPath("keytool")
+	if err != nil {
+		return fmt.Errorf("keytool not found in PATH")
+	}
+
+	keystores := javaKeystores()
+	if len(keystores) == 0 {
+		return fmt.Errorf("no Java cacerts found - set java_keystore in [trust_stores]")
+	}
+
+	alias := trustAliasFor(cert)
+	var failed []string
+	for _, keystore := range keystores {
+		if aliases, _ := javaAliasesFor(keytool, keystore, cert); len(aliases) > 0 {
+			log.Printf("Certificate already in Java keystore %s as %s", keystore, strings.Join(aliases, ", "))
+			continue
+		}
+
+		output, err := runAsOwner(keystore, keytool, "-importcert", "-noprompt", "-trustcacerts",
+			"-alias", alias, "-file", certPath,
+			"-keystore", keystore, "-storepass", currentConfig().JavaKeystorePassword)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v - %s", keystore, err, strings.TrimSpace(string(output))))
+			continue
+		}
+		recordTrustInstall(cert, trustInstallEntry{Store: trustStoreJava, Location: keystore, Name: alias})
+		log.Printf("Certificate installed in Java keystore: %s", keystore)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// javaAliasesFor parses "keytool -list", where each "alias, date, type,"
+// line is followed by the entry's SHA-256 fingerprint.
+func javaAliasesFor(keytool, keystore string, cert *x509.Certificate) ([]string, error) {
+	output, err := exec.Command(keytool, "-list", "-keystore", keystore, "-storepass", currentConfig().JavaKeystorePassword).Output()
+	if err != nil {
+		return nil, fmt.Errorf("keytool -list failed: %v", err)
+	}
+
+	fingerprint := certFingerprintColons(cert, crypto.SHA256)
+	var aliases []string
+	alias := ""
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasSuffix(strings.TrimSpace(line), "Entry,") {
+			alias = line[:strings.Index(line, ",")]
+		} else if alias != "" && strings.Contains(line, fingerprint) {
+			aliases = append(aliases, alias)
+			alias = ""
+		}
+	}
+	return aliases, nil
+}
+
+// runAsOwner runs a command that modifies path, going through sudo when the
+// file is not writable by the current user (e.g. the JDK's cacerts).
+func runAsOwner(path, name string, args ...string) ([]byte, error) {
+	writable := false
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		f.Close()
+		writable = true
+	}
+	if !writable && currentConfig().UserTrust {
+		return nil, fmt.Errorf("%s is not writable without sudo (user scope)", path)
+	}
+	return runTrustCommand(!writable, name, args...)
+}
+
+// ============================================================================
+// TRUST INSTALL RECORD
+// ============================================================================
+
+const trustRecordFile = "trust-installs.json"
+
+const (
+	trustStoreWindows = "windows"
+	trustStoreMacOS   = "macos"
+	trustStoreSystem  = "system"
+	trustStoreNSS     = "nss"
+	trustStoreJava    = "java"
+
+	windowsRootStore = `CurrentUser\Root`
+	p11KitLocation   = "p11-kit"
+)
+
+// trustRecordPath is set from -certdir at startup.
+var trustRecordPath = trustRecordFile
+
+// trustInstallEntry is one place the CA was added to. Location is the
+// anchor file, keychain, NSS directory or keystore; Name is the NSS nickname,
+// keytool alias or, for system entries, the Linux layout.
+type trustInstallEntry struct {
+	Store    string `json:"store"`
+	Location string `json:"location"`
+	Name     string `json:"name,omitempty"`
+}
+
+// trustInstallRecord keeps the certificate itself so -cleanup can still
+// identify it after the CA files are gone or rotated.
+type trustInstallRecord struct {
+	Fingerprint string              `json:"fingerprint"`
+	Subject     string              `json:"subject"`
+	CertPEM     string              `json:"cert_pem"`
+	Installed   []trustInstallEntry `json:"installed"`
+}
+
+// trustAliasFor names the CA in NSS, keytool and anchor directories. It is
+// derived from the fingerprint so a different CA is never touched.
+func trustAliasFor(cert *x509.Certificate) string {
+	return "tlsproxy-" + certFingerprint(cert)[:16]
+}
+
+func loadTrustRecords() []trustInstallRecord {
+	data, err := os.ReadFile(trustRecordPath)
+	if err != nil {
+		return nil
+	}
+
+	var records []trustInstallRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		log.Printf("WARNING: Ignoring unreadable %s: %v", trustRecordPath, err)
+		return nil
+	}
+	return records
+}
+
+func saveTrustRecords(records []trustInstallRecord) {
+	if len(records) == 0 {
+		os.Remove(trustRecordPath)
+		return
+	}
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err == nil {
+		err = os.WriteFile(trustRecordPath, data, 0644)
+	}
+	if err != nil {
+		log.Printf("WARNING: Could not save %s: %v", trustRecordPath, err)
+	}
+}
+
+func recordTrustInstall(cert *x509.Certificate, entry trustInstallEntry) {
+	if currentConfig().TrustDryRun {
+		return
+	}
+
+	records := loadTrustRecords()
+	fingerprint := certFingerprint(cert)
+
+	idx := -1
+	for i := range records {
+		if records[i].Fingerprint == fingerprint {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		records = append(records, trustInstallRecord{
+			Fingerprint: fingerprint,
+			Subject:     cert.Subject.String(),
+			CertPEM:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		})
+		idx = len(records) - 1
+	}
+
+	for _, existing := range records[idx].Installed {
+		if existing == entry {
+			return
+		}
+	}
+	records[idx].Installed = append(records[idx].Installed, entry)
+	saveTrustRecords(records)
+}
+
+// recordedCAs returns every CA the install record still lists.
+func recordedCAs() []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, record := range loadTrustRecords() {
+		block, _ := pem.Decode([]byte(record.CertPEM))
+		if block == nil {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// uninstallCert removes the CA from exactly the recorded locations. Without
+// a record it falls back to searching every store for its fingerprint.
+func uninstallCert(cert *x509.Certificate) error {
+	fingerprint := certFingerprint(cert)
+	records := loadTrustRecords()
+
+	recorded := -1
+	var entries []trustInstallEntry
+	for i, record := range records {
+		if record.Fingerprint == fingerprint {
+			recorded = i
+			entries = record.Installed
+		}
+	}
+	if recorded < 0 {
+		entries = findTrustEntries(cert)
+	}
+
+	if len(entries) == 0 {
+		log.Printf("CA %s not found in any trust store", certFingerprintColons(cert, crypto.SHA256))
+		return nil
+	}
+
+	var failed []string
+	var remaining []trustInstallEntry
+	for _, entry := range entries {
+		if err := removeTrustEntry(cert, entry); err != nil {
+			failed = append(failed, fmt.Sprintf("%s %s: %v", entry.Store, entry.Location, err))
+			remaining = append(remaining, entry)
+			continue
+		}
+		log.Printf("Removed CA from %s trust store: %s", entry.Store, entry.Location)
+	}
+
+	if recorded >= 0 && !currentConfig().TrustDryRun {
+		if len(remaining) == 0 {
+			records = append(records[:recorded], records[recorded+1:]...)
+		} else {
+			records[recorded].Installed = remaining
+		}
+		saveTrustRecords(records)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// findTrustEntries locates the CA by fingerprint in every store the proxy
+// manages on this platform.
+func findTrustEntries(cert *x509.Certificate) []trustInstallEntry {
+	var entries []trustInstallEntry
+
+	switch runtime.GOOS {
+	case "windows":
+		if present, _ := windowsStoreContains(cert); present {
+			entries = append(entries, trustInstallEntry{Store: trustStoreWindows, Location: windowsRootStore})
+		}
+		return entries
+	case "darwin":
+		home, _ := os.UserHomeDir()
+		for _, keychain := range []string{
+			"/Library/Keychains/System.keychain",
+			filepath.Join(home, "Library", "Keychains", "login.keychain-db"),
+		} {
+			if present, _ := macKeychainContains(cert, keychain); present {
+				entries = append(entries, trustInstallEntry{Store: trustStoreMacOS, Location: keychain})
+			}
+		}
+		return entries
+	case "linux":
+		entries = append(entries, findLinuxSystemEntries(cert)...)
+	}
+
+	if currentConfig().InstallNSS {
+		if certutil, err := nssCertutil(); err == nil {
+			for _, db := range findNSSDatabases() {
+				for _, nickname := range nssNicknamesFor(certutil, db.Dir, cert) {
+					entries = append(entries, trustInstallEntry{Store: trustStoreNSS, Location: db.Dir, Name: nickname})
+				}
+			}
+		}
+	}
+	if currentConfig().InstallJava {
+		if keytool, err := exec.LookPath("keytool"); err == nil {
+			for _, keystore := range javaKeystores() {
+				aliases, _ := javaAliasesFor(keytool, keystore, cert)
+				for _, alias := range aliases {
+					entries = append(entries, trustInstallEntry{Store: trustStoreJava, Location: keystore, Name: alias})
+				}
+			}
+		}
+	}
+	return entries
+}
+
+func removeTrustEntry(cert *x509.Certificate, entry trustInstallEntry) error {
+	switch entry.Store {
+	case trustStoreWindows:
+		return runTrustCommandChecked(false, "certutil", "-user", "-delstore", "Root", sha1Thumbprint(cert))
+	case trustStoreMacOS:
+		home, _ := os.UserHomeDir()
+		privileged := home == "" || !strings.HasPrefix(entry.Location, home)
+		return runTrustCommandChecked(privileged, "security", "delete-certificate", "-Z", sha1Thumbprint(cert), "-t", entry.Location)
+	case trustStoreSystem:
+		if entry.Location == p11KitLocation {
+			return withTempCertFile(cert, func(path string) error {
+				return runTrustCommandChecked(true, "trust", "anchor", "--remove", path)
+			})
+		}
+		if err := runTrustCommandChecked(true, "rm", "-f", entry.Location); err != nil {
+			return err
+		}
+		if layout, ok := linuxTrustLayouts[entry.Name]; ok && len(layout.Refresh) > 0 {
+			return runTrustCommandChecked(true, layout.Refresh[0], layout.Refresh[1:]...)
+		}
+		return nil
+	case trustStoreNSS:
+		certutil, err := nssCertutil()
+		if err != nil {
+			return err
+		}
+		return runTrustCommandChecked(false, certutil, "-D", "-d", "sql:"+entry.Location, "-n", entry.Name)
+	case trustStoreJava:
+		keytool, err := exec.LookPath("keytool")
+		if err != nil {
+			return fmt.Errorf("keytool not found in PATH")
+		}
+		output, err := runAsOwner(entry.Location, keytool, "-delete", "-alias", entry.Name,
+			"-keystore", entry.Location, "-storepass", currentConfig().JavaKeystorePassword)
+		if err != nil {
+			return fmt.Errorf("%v - %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown trust store %q", entry.Store)
+}
+
+// withTempCertFile calls fn with the certificate written to a temp PEM file.
+func withTempCertFile(cert *x509.Certificate, fn func(certPath string) error) error {
+	tmp, err := os.CreateTemp("", "tlsproxy-ca-*.crt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	pem.Encode(tmp, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	tmp.Close()
+	return fn(tmp.Name())
+}
+
+// ============================================================================
+// LEAF KEY POOL
+// ============================================================================
+
+// KeyPool keeps a buffer of pre-generated RSA keys so that minting a leaf
+// for a new hostname only costs a signature, not a 2048-bit keygen.
+type KeyPool struct {
+	keys   chan *rsa.PrivateKey
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewKeyPool(size int) *KeyPool {
+	pool := &KeyPool{keys: make(chan *rsa.PrivateKey, size)}
+	if size <= 0 {
+		return pool
+	}
+
+	workers := 2
+	if size < workers {
+		workers = size
+	}
+	for i := 0; i < workers; i++ {
+		go pool.fill()
+	}
+
+	log.Printf("[KEYPOOL] Pre-generating %d leaf keys in background", size)
+	return pool
+}
+
+func (p *KeyPool) fill() {
+	for {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Printf("[KEYPOOL] Key generation failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p.keys <- key
+	}
+}
+
+// Get returns a pooled key, or generates one inline when the pool is empty
+// or disabled.
+func (p *KeyPool) Get() (*rsa.PrivateKey, error) {
+	if p != nil {
+		select {
+		case key := <-p.keys:
+			p.hits.Add(1)
+			return key, nil
+		default:
+			p.misses.Add(1)
+		}
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func (p *KeyPool) Stats() map[string]interface{} {
+	if p == nil {
+		return map[string]interface{}{"size": 0}
+	}
+	return map[string]interface{}{
+		"size":      cap(p.keys),
+		"available": len(p.keys),
+		"hits":      p.hits.Load(),
+		"misses":    p.misses.Load(),
+	}
+}
+
+// ============================================================================
+// MAIN FUNCTION
+// ============================================================================
+
+func main() {
+	// Settings flags are applied through buildConfig, see flagSettings
+	flag.Int("port", 8080, "Proxy port")
+	cleanup := flag.Bool("cleanup", false, "Remove CA certificates and exit")
+	flag.String("certdir", ".", "Certificate directory")
+	flag.Bool("skip-install", false, "Skip automatic certificate installation")
+	configFile := flag.String("config", "proxy-config.ini", "Configuration file path (env TLSPROXY_CONFIG)")
+	flag.Int("monitor-port", 4040, "Monitor web interface port")
+	flag.Bool("verbose", false, "Enable verbose logging (log all traffic to console)")
+	flag.Bool("user", false, "Only use per-user trust stores (no sudo)")
+	flag.Bool("dry-run", false, "Print trust store commands instead of running them")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	dumpConfigFlag := flag.Bool("dump-config", false, "Print the effective configuration and exit")
+	flag.Parse()
+
+	configPath, explicitConfig := *configFile, false
+	flag.Visit(func(f *flag.Flag) {
+		explicitConfig = explicitConfig || f.Name == "config"
+	})
+	if env := os.Getenv("TLSPROXY_CONFIG"); env != "" && !explicitConfig {
+		configPath, explicitConfig = env, true
+	}
+
+	configFilePath, configFileExplicit = configPath, explicitConfig
+	cfg, sources, err := buildConfig(configPath, explicitConfig)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	activeConfig.Store(cfg)
+
+	if *checkConfig {
+		log.Printf("Configuration OK: %s", configPath)
+		return
+	}
+	if *dumpConfigFlag {
+		dumpConfig(os.Stdout, cfg, sources)
+		return
+	}
+
+	config := &ProxyConfig{
+		Port:        cfg.Port,
+		CertDir:     cfg.CertDir,
+		LogFile:     filepath.Join(cfg.CertDir, logFile),
+		SkipInstall: cfg.SkipInstall,
+	}
+	trustRecordPath = filepath.Join(cfg.CertDir, trustRecordFile)
+
+	if *cleanup {
+		cleanupCerts(config)
+		return
+	}
+
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "ca" {
+			log.Fatalf("Unknown command %q (available: ca)", flag.Arg(0))
+		}
+		if err := runCACommand(config, flag.Args()[1:]); err != nil {
+			log.Fatalf("ca: %v", err)
+		}
+		return
+	}
+
+	if err := initCA(config); err != nil {
+		log.Fatalf("Failed to initialize CA: %v", err)
+	}
+
+	if cfg.RevocationResponder {
+		StartRevocationResponder(cfg.ResponderAddr)
+	}
+
+	if cfg.CTEnabled {
+		logs, err := loadFakeCTLogs(config.CertDir, cfg.CTLogCount)
+		if err != nil {
+			log.Printf("WARNING: Certificate Transparency simulation disabled: %v", err)
+		}
+		ctLogs = logs
+	}
+
+	leafKeyPool = NewKeyPool(cfg.KeyPoolSize)
+	certCache.maxEntries = cfg.CacheMaxEntries
+	if cfg.DiskCache {
+		if err := certCache.EnableDiskCache(filepath.Join(config.CertDir, hostCertDir)); err != nil {
+			log.Printf("WARNING: Host certificate disk cache disabled: %v", err)
+		}
+	}
+
+	logWriter, err = os.OpenFile(config.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+	defer logWriter.Close()
+
+	initializeModules()
+
+	go handleReloadSignals()
+	if cfg.UseIntermediate && cfg.ImportP12 == "" && cfg.ImportCert == "" {
+		go watchIntermediateCA(config)
+	}
+	if cfg.WatchConfig {
+		go watchConfigFile(configFilePath)
+	}
+
+	StartMonitorServer(cfg.MonitorBind, cfg.MonitorPort)
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(cfg.ProxyBind, strconv.Itoa(config.Port)))
+	if err != nil {
+		log.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer listener.Close()
 
-	log.Printf("Proxy listening on port %d", config.Port)
-	log.Printf("Monitor interface: http://localhost:%d", *monitorPort)
+	log.Printf("Proxy listening on %s", listener.Addr())
+	if !isLoopbackBind(cfg.ProxyBind) && cfg.ProxyUsername == "" && len(cfg.AllowedClients) == 0 {
+		log.Printf("WARNING: The proxy is reachable on %s without authentication or an allowlist", cfg.ProxyBind)
+	}
+	if !isLoopbackBind(cfg.MonitorBind) && cfg.MonitorToken == "" && len(cfg.AllowedClients) == 0 {
+		log.Printf("WARNING: The monitor exposes captured tokens on %s without a monitor_token or an allowlist", cfg.MonitorBind)
+	}
+	log.Printf("Monitor interface: http://localhost:%d", cfg.MonitorPort)
 	log.Printf("CA certificate: %s", filepath.Join(config.CertDir, caCertFile))
 	log.Printf("Log file: %s", config.LogFile)
 	log.Printf("⚠️  TOKEN CAPTURE: JWT and OAuth tokens will be exported to captured_tokens.json")
@@ -2249,7 +9962,7 @@ func main() {
 	log.Printf("WARNING: These files contain sensitive authentication data!")
 	log.Printf("WARNING: File permissions set to 0600 for captured_tokens.json")
 	
-	if verboseMode {
+	if cfg.Verbose {
 		log.Printf("Verbose mode: ENABLED (all traffic logged to console)")
 	} else {
 		log.Printf("Verbose mode: DISABLED (use -verbose flag to enable console logging)")
@@ -2261,127 +9974,559 @@ func main() {
 			log.Printf("Accept error: %v", err)
 			continue
 		}
+		if !clientAllowed(conn.RemoteAddr().String()) {
+			log.Printf("[AUTH] Connection from %s rejected by allowlist", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		go handleConnection(conn, config)
 	}
 }
 
 func initializeModules() {
 	log.Println("Initializing logging modules...")
+	moduleBuild = pipeline{}
+	cfg := currentConfig()
+
+	if cfg.BuiltinModules {
+		RegisterObserver(NewMonitoringModule())
+		RegisterObserver(logModuleAdapter{NewTokenExportModule()})
+	}
+	for _, mc := range orderedModules(cfg) {
+		module, err := newConfiguredModule(mc)
+		if err != nil {
+			log.Printf("[MODULE] Skipping [module.%s]: %v", mc.Name, err)
+			continue
+		}
+		module.register()
+	}
+
+	p := moduleBuild
+	retainPlugins(&p)
+	activeModules.Store(&p)
+	log.Printf("Total modules registered: %d (%d scope filter groups)", len(p.modules), len(p.scope.groups))
+}
+
+// ============================================================================
+// CONFIGURATION
+// ============================================================================
+
+// Settings are resolved flag > environment > config file > default. Every
+// INI key can also be set as TLSPROXY_<SECTION>_<KEY>, e.g.
+// TLSPROXY_SERVER_PORT or TLSPROXY_HOST_CERTIFICATES_VALIDITY_DAYS.
+const configEnvPrefix = "TLSPROXY_"
+
+// configSetting is one "key = value" line of proxy-config.ini.
+type configSetting struct {
+	Section string
+	Key     string
+	Secret  bool
+	get     func(c *CertConfig) string
+	set     func(c *CertConfig, value string) error
+}
+
+func (s configSetting) name() string { return s.Section + "." + s.Key }
+
+func stringSetting(section, key string, field func(c *CertConfig) *string) configSetting {
+	return configSetting{
+		Section: section,
+		Key:     key,
+		get:     func(c *CertConfig) string { return *field(c) },
+		set: func(c *CertConfig, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func secretSetting(section, key string, field func(c *CertConfig) *string) configSetting {
+	s := stringSetting(section, key, field)
+	s.Secret = true
+	return s
+}
+
+func intSetting(section, key string, min, max int, field func(c *CertConfig) *int) configSetting {
+	return configSetting{
+		Section: section,
+		Key:     key,
+		get:     func(c *CertConfig) string { return strconv.Itoa(*field(c)) },
+		set: func(c *CertConfig, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", value)
+			}
+			if v < min || v > max {
+				return fmt.Errorf("%d is out of range (%d-%d)", v, min, max)
+			}
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func boolSetting(section, key string, field func(c *CertConfig) *bool) configSetting {
+	return configSetting{
+		Section: section,
+		Key:     key,
+		get:     func(c *CertConfig) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *CertConfig, value string) error {
+			v, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func listSetting(section, key string, field func(c *CertConfig) *[]string) configSetting {
+	return configSetting{
+		Section: section,
+		Key:     key,
+		get:     func(c *CertConfig) string { return strings.Join(*field(c), ", ") },
+		set: func(c *CertConfig, value string) error {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+	}
+}
+
+func choiceSetting(section, key string, choices []string, field func(c *CertConfig) *string) configSetting {
+	return configSetting{
+		Section: section,
+		Key:     key,
+		get:     func(c *CertConfig) string { return *field(c) },
+		set: func(c *CertConfig, value string) error {
+			value = strings.ToLower(value)
+			for _, choice := range choices {
+				if value == choice {
+					*field(c) = value
+					return nil
+				}
+			}
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(choices, ", "))
+		},
+	}
+}
+
+const maxConfigInt = 1 << 30
+
+var ctModes = []string{ctValid, ctInvalid, ctMalformed, ctMissing}
+
+var configSettings = []configSetting{
+	intSetting("server", "port", 1, 65535, func(c *CertConfig) *int { return &c.Port }),
+	intSetting("server", "monitor_port", 1, 65535, func(c *CertConfig) *int { return &c.MonitorPort }),
+	stringSetting("server", "cert_dir", func(c *CertConfig) *string { return &c.CertDir }),
+	boolSetting("server", "skip_install", func(c *CertConfig) *bool { return &c.SkipInstall }),
+	boolSetting("server", "verbose", func(c *CertConfig) *bool { return &c.Verbose }),
+	boolSetting("server", "watch_config", func(c *CertConfig) *bool { return &c.WatchConfig }),
+	stringSetting("server", "bind", func(c *CertConfig) *string { return &c.ProxyBind }),
+	stringSetting("server", "monitor_bind", func(c *CertConfig) *string { return &c.MonitorBind }),
+	listSetting("server", "allow", func(c *CertConfig) *[]string { return &c.AllowedClients }),
+
+	stringSetting("auth", "proxy_username", func(c *CertConfig) *string { return &c.ProxyUsername }),
+	secretSetting("auth", "proxy_password", func(c *CertConfig) *string { return &c.ProxyPassword }),
+	secretSetting("auth", "monitor_token", func(c *CertConfig) *string { return &c.MonitorToken }),
+
+	stringSetting("ca_certificate", "organization", func(c *CertConfig) *string { return &c.Organization }),
+	stringSetting("ca_certificate", "common_name", func(c *CertConfig) *string { return &c.CommonName }),
+	intSetting("ca_certificate", "validity_years", 1, 100, func(c *CertConfig) *int { return &c.ValidityYears }),
+	boolSetting("ca_certificate", "use_intermediate", func(c *CertConfig) *bool { return &c.UseIntermediate }),
+	stringSetting("ca_certificate", "intermediate_common_name", func(c *CertConfig) *string { return &c.IntermediateCommonName }),
+	intSetting("ca_certificate", "intermediate_validity_days", 1, 36500, func(c *CertConfig) *int { return &c.IntermediateValidityDays }),
+	stringSetting("ca_certificate", "import_cert", func(c *CertConfig) *string { return &c.ImportCert }),
+	stringSetting("ca_certificate", "import_key", func(c *CertConfig) *string { return &c.ImportKey }),
+	stringSetting("ca_certificate", "import_p12", func(c *CertConfig) *string { return &c.ImportP12 }),
+	secretSetting("ca_certificate", "import_p12_password", func(c *CertConfig) *string { return &c.ImportP12Password }),
+
+	stringSetting("certificate_extensions", "aia_urls", func(c *CertConfig) *string { return &c.AIAURLs }),
+	listSetting("certificate_extensions", "crl_distribution_points", func(c *CertConfig) *[]string { return &c.CRLDistPoints }),
+	stringSetting("certificate_extensions", "ocsp_url", func(c *CertConfig) *string { return &c.OCSPServer }),
+
+	boolSetting("revocation", "enabled", func(c *CertConfig) *bool { return &c.RevocationResponder }),
+	stringSetting("revocation", "listen", func(c *CertConfig) *string { return &c.ResponderAddr }),
+	stringSetting("revocation", "base_url", func(c *CertConfig) *string { return &c.ResponderURL }),
+	boolSetting("revocation", "ocsp_stapling", func(c *CertConfig) *bool { return &c.OCSPStapling }),
+
+	boolSetting("ct", "enabled", func(c *CertConfig) *bool { return &c.CTEnabled }),
+	choiceSetting("ct", "default_mode", ctModes, func(c *CertConfig) *string { return &c.CTDefaultMode }),
+	intSetting("ct", "log_count", 1, 16, func(c *CertConfig) *int { return &c.CTLogCount }),
+
+	boolSetting("trust_stores", "nss", func(c *CertConfig) *bool { return &c.InstallNSS }),
+	boolSetting("trust_stores", "java", func(c *CertConfig) *bool { return &c.InstallJava }),
+	stringSetting("trust_stores", "java_keystore", func(c *CertConfig) *string { return &c.JavaKeystore }),
+	secretSetting("trust_stores", "java_keystore_password", func(c *CertConfig) *string { return &c.JavaKeystorePassword }),
+	choiceSetting("trust_stores", "linux_layout", []string{"auto", "debian", "rhel", "arch", "alpine", "suse"}, func(c *CertConfig) *string { return &c.LinuxTrustLayout }),
+	boolSetting("trust_stores", "user_scope", func(c *CertConfig) *bool { return &c.UserTrust }),
+	boolSetting("trust_stores", "dry_run", func(c *CertConfig) *bool { return &c.TrustDryRun }),
+
+	boolSetting("modules", "builtin", func(c *CertConfig) *bool { return &c.BuiltinModules }),
+
+	stringSetting("dns", "server", func(c *CertConfig) *string { return &c.DNSServer }),
+
+	listSetting("host_certificates", "default_san_entries", func(c *CertConfig) *[]string { return &c.DefaultSANs }),
+	intSetting("host_certificates", "validity_days", 1, 36500, func(c *CertConfig) *int { return &c.HostValidityDays }),
+	boolSetting("host_certificates", "include_aia_in_host_certs", func(c *CertConfig) *bool { return &c.IncludeAIAInHosts }),
+	boolSetting("host_certificates", "include_cdp_in_host_certs", func(c *CertConfig) *bool { return &c.IncludeCDPInHosts }),
+	intSetting("host_certificates", "key_pool_size", 0, 1024, func(c *CertConfig) *int { return &c.KeyPoolSize }),
+	boolSetting("host_certificates", "disk_cache", func(c *CertConfig) *bool { return &c.DiskCache }),
+	intSetting("host_certificates", "cache_max_entries", 0, maxConfigInt, func(c *CertConfig) *int { return &c.CacheMaxEntries }),
+	intSetting("host_certificates", "renew_before_days", 0, 36500, func(c *CertConfig) *int { return &c.RenewBeforeDays }),
+	{
+		Section: "host_certificates",
+		Key:     "mimic_upstream",
+		get:     func(c *CertConfig) string { return c.MimicUpstream },
+		set: func(c *CertConfig, value string) error {
+			switch value = strings.ToLower(value); value {
+			case mimicConnect, mimicLazy, mimicOff:
+				c.MimicUpstream = value
+				return nil
+			}
+			on, err := parseBool(value)
+			if err != nil {
+				return fmt.Errorf("%q is not one of %s, %s, %s", value, mimicOff, mimicConnect, mimicLazy)
+			}
+			c.MimicUpstream = mimicOff
+			if on {
+				c.MimicUpstream = mimicConnect
+			}
+			return nil
+		},
+	},
+}
+
+// Pattern sections hold "host pattern = value" lines instead of fixed keys.
+var configPatternSections = map[string]func(c *CertConfig, pattern, value string) error{
+	"ct_hosts": func(c *CertConfig, pattern, value string) error {
+		value = strings.ToLower(value)
+		if !slices.Contains(ctModes, value) {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(ctModes, ", "))
+		}
+		c.CTHostModes = append(c.CTHostModes, hostPatternSetting{Pattern: pattern, Value: value})
+		return nil
+	},
+	"cert_faults": func(c *CertConfig, pattern, value string) error {
+		for _, fault := range strings.Split(value, ",") {
+			fault = strings.ToLower(strings.TrimSpace(fault))
+			if fault != "none" && !slices.Contains(knownCertFaults, fault) {
+				return fmt.Errorf("unknown certificate fault %q (known: %s)", fault, strings.Join(knownCertFaults, ", "))
+			}
+		}
+		c.CertFaults = append(c.CertFaults, hostPatternSetting{Pattern: pattern, Value: value})
+		return nil
+	},
+	"dns_hosts": func(c *CertConfig, pattern, value string) error {
+		for _, ip := range strings.Split(value, ",") {
+			if net.ParseIP(strings.TrimSpace(ip)) == nil {
+				return fmt.Errorf("%q is not an IP address", strings.TrimSpace(ip))
+			}
+		}
+		c.DNSHosts = append(c.DNSHosts, hostPatternSetting{Pattern: pattern, Value: value})
+		return nil
+	},
+}
+
+// flagSettings maps command line flags onto the INI keys they override.
+var flagSettings = map[string]string{
+	"port":         "server.port",
+	"monitor-port": "server.monitor_port",
+	"certdir":      "server.cert_dir",
+	"skip-install": "server.skip_install",
+	"verbose":      "server.verbose",
+	"user":         "trust_stores.user_scope",
+	"dry-run":      "trust_stores.dry_run",
+}
 
-	RegisterModule(&AllTrafficModule{})
-	RegisterModule(NewMonitoringModule())
-	RegisterModule(NewTokenExportModule())
+func findConfigSetting(name string) (configSetting, bool) {
+	for _, s := range configSettings {
+		if s.name() == name {
+			return s, true
+		}
+	}
+	return configSetting{}, false
+}
 
-	log.Printf("Total modules registered: %d", len(logModules))
+func isConfigSection(section string) bool {
+	if _, ok := configPatternSections[section]; ok {
+		return true
+	}
+	if name, ok := strings.CutPrefix(section, moduleSectionPrefix); ok {
+		return name != ""
+	}
+	for _, s := range configSettings {
+		if s.Section == section {
+			return true
+		}
+	}
+	return false
 }
 
-func loadConfig(configPath string) *CertConfig {
+// configSources records where each non-default setting came from, for
+// -dump-config.
+type configSources map[string]string
+
+// buildConfig merges defaults, the config file, TLSPROXY_* environment
+// variables and explicitly set flags, and validates the result. All
+// problems are reported together.
+func buildConfig(configPath string, explicitPath bool) (*CertConfig, configSources, error) {
 	config := defaultCertConfig()
+	sources := configSources{}
 
+	var errs []error
+	errs = append(errs, loadConfigFile(config, sources, configPath, explicitPath)...)
+	errs = append(errs, applyEnvConfig(config, sources)...)
+	errs = append(errs, applyFlagConfig(config, sources)...)
+	errs = append(errs, validateConfig(config)...)
+
+	return config, sources, errors.Join(errs...)
+}
+
+func loadConfigFile(config *CertConfig, sources configSources, configPath string, explicitPath bool) []error {
 	if !fileExists(configPath) {
+		if explicitPath {
+			return []error{fmt.Errorf("config file not found: %s", configPath)}
+		}
 		log.Printf("Config file not found: %s (using defaults)", configPath)
-		return config
+		return nil
 	}
 
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		log.Printf("Failed to read config file: %v (using defaults)", err)
-		return config
+		return []error{fmt.Errorf("failed to read config file: %v", err)}
 	}
 
-	lines := strings.Split(string(data), "\n")
+	var errs []error
 	currentSection := ""
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	for i, line := range strings.Split(string(data), "\n") {
+		where := fmt.Sprintf("%s:%d", configPath, i+1)
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			currentSection = strings.TrimSpace(strings.Trim(line, "[]"))
+			if !isConfigSection(currentSection) {
+				errs = append(errs, fmt.Errorf("%s: unknown section [%s]", where, currentSection))
+			} else if name, ok := strings.CutPrefix(currentSection, moduleSectionPrefix); ok {
+				config.moduleSection(name, where)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: expected \"key = value\", got %q", where, line))
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if currentSection == "" {
+			errs = append(errs, fmt.Errorf("%s: %s is outside of any section", where, key))
+			continue
+		}
+		if !isConfigSection(currentSection) {
+			continue
+		}
+		if err := setConfigValue(config, sources, currentSection, key, value, where); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", where, err))
+		}
+	}
+
+	log.Printf("Loaded configuration from: %s", configPath)
+	return errs
+}
+
+// setConfigValue applies one value. The section and key are always checked,
+// so an empty value never hides a typo. An empty value clears string and
+// list settings and is an error for numbers, booleans and choices.
+func setConfigValue(config *CertConfig, sources configSources, section, key, value, source string) error {
+	if set, ok := configPatternSections[section]; ok {
+		if err := set(config, key, value); err != nil {
+			return fmt.Errorf("[%s] %s: %v", section, key, err)
+		}
+		return nil
+	}
+
+	if name, ok := strings.CutPrefix(section, moduleSectionPrefix); ok {
+		if err := setModuleValue(config, name, key, value, source); err != nil {
+			return fmt.Errorf("[%s] %v", section, err)
+		}
+		return nil
+	}
+
+	setting, ok := findConfigSetting(section + "." + key)
+	if !ok {
+		return fmt.Errorf("unknown key %q in [%s]", key, section)
+	}
+	if err := setting.set(config, value); err != nil {
+		return fmt.Errorf("[%s] %s: %v", section, key, err)
+	}
+	sources[setting.name()] = source
+	return nil
+}
 
-		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+// applyEnvConfig maps TLSPROXY_<SECTION>_<KEY> onto the matching setting.
+// Variables that don't start with a known section (like
+// TLSPROXY_P12_PASSWORD) are left alone.
+func applyEnvConfig(config *CertConfig, sources configSources) []error {
+	var errs []error
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, configEnvPrefix) {
 			continue
 		}
+		rest := strings.ToLower(strings.TrimPrefix(name, configEnvPrefix))
 
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			currentSection = strings.Trim(line, "[]")
+		section := ""
+		for _, s := range configSettings {
+			if strings.HasPrefix(rest, s.Section+"_") && len(s.Section) > len(section) {
+				section = s.Section
+			}
+		}
+		if section == "" {
 			continue
 		}
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+		key := strings.TrimPrefix(rest, section+"_")
+		if err := setConfigValue(config, sources, section, key, value, name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
 		}
+	}
+	return errs
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+// applyFlagConfig applies flags that were given explicitly on the command
+// line, so a flag's default never hides a file or environment value.
+func applyFlagConfig(config *CertConfig, sources configSources) []error {
+	var errs []error
+	flag.Visit(func(f *flag.Flag) {
+		name, ok := flagSettings[f.Name]
+		if !ok {
+			return
+		}
+		section, key, _ := strings.Cut(name, ".")
+		if err := setConfigValue(config, sources, section, key, f.Value.String(), "-"+f.Name); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %v", f.Name, err))
+		}
+	})
+	return errs
+}
 
-		if value == "" {
-			continue
+// validateConfig checks settings that depend on each other.
+func validateConfig(config *CertConfig) []error {
+	var errs []error
+	if config.Port == config.MonitorPort {
+		errs = append(errs, fmt.Errorf("[server] port and monitor_port are both %d", config.Port))
+	}
+	if (config.ImportCert == "") != (config.ImportKey == "") {
+		errs = append(errs, fmt.Errorf("[ca_certificate] import_cert and import_key must be set together"))
+	}
+	if config.ImportP12 != "" && config.ImportCert != "" {
+		errs = append(errs, fmt.Errorf("[ca_certificate] import_p12 and import_cert are mutually exclusive"))
+	}
+	if config.RevocationResponder {
+		if _, _, err := net.SplitHostPort(config.ResponderAddr); err != nil {
+			errs = append(errs, fmt.Errorf("[revocation] listen: %v", err))
+		}
+	}
+	if config.ResponderURL != "" {
+		if u, err := url.Parse(config.ResponderURL); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("[revocation] base_url: %q is not an absolute URL", config.ResponderURL))
 		}
+	}
+	for _, bind := range []struct{ key, value string }{{"bind", config.ProxyBind}, {"monitor_bind", config.MonitorBind}} {
+		if bind.value != "localhost" && net.ParseIP(bind.value) == nil {
+			errs = append(errs, fmt.Errorf("[server] %s: %q is not an IP address", bind.key, bind.value))
+		}
+	}
+	if _, err := parseAllowList(config.AllowedClients); err != nil {
+		errs = append(errs, fmt.Errorf("[server] allow: %v", err))
+	}
+	if (config.ProxyUsername == "") != (config.ProxyPassword == "") {
+		errs = append(errs, fmt.Errorf("[auth] proxy_username and proxy_password must be set together"))
+	}
+	if _, err := newDNSResolver(config.DNSServer); err != nil {
+		errs = append(errs, fmt.Errorf("[dns] server: %v", err))
+	}
+	return append(errs, validateModules(config)...)
+}
 
-		switch currentSection {
-		case "ca_certificate":
-			switch key {
-			case "organization":
-				config.Organization = value
-			case "common_name":
-				config.CommonName = value
-			case "validity_years":
-				if v, err := parseInt(value); err == nil {
-					config.ValidityYears = v
-				}
-			}
-		case "certificate_extensions":
-			switch key {
-			case "aia_urls":
-				config.AIAURLs = value
-			case "crl_distribution_points":
-				if value != "" {
-					config.CRLDistPoints = strings.Split(value, ",")
-					for i := range config.CRLDistPoints {
-						config.CRLDistPoints[i] = strings.TrimSpace(config.CRLDistPoints[i])
-					}
-				}
-			case "ocsp_url":
-				config.OCSPServer = value
-			}
-		case "host_certificates":
-			switch key {
-			case "default_san_entries":
-				if value != "" {
-					config.DefaultSANs = strings.Split(value, ",")
-					for i := range config.DefaultSANs {
-						config.DefaultSANs[i] = strings.TrimSpace(config.DefaultSANs[i])
-					}
-				}
-			case "validity_days":
-				if v, err := parseInt(value); err == nil {
-					config.HostValidityDays = v
-				}
-			case "include_aia_in_host_certs":
-				config.IncludeAIAInHosts = parseBool(value)
-			case "include_cdp_in_host_certs":
-				config.IncludeCDPInHosts = parseBool(value)
+// dumpConfig writes the effective configuration as INI, noting where each
+// non-default value came from. Secrets are masked.
+func dumpConfig(w io.Writer, config *CertConfig, sources configSources) {
+	section := ""
+	for _, s := range configSettings {
+		if s.Section != section {
+			if section != "" {
+				fmt.Fprintln(w)
 			}
+			section = s.Section
+			fmt.Fprintf(w, "[%s]\n", section)
+		}
+
+		// Sources go on their own line so the output loads back as-is;
+		// secrets stay commented out so they are never echoed
+		if source, ok := sources[s.name()]; ok {
+			fmt.Fprintf(w, "# from %s\n", source)
+		}
+		value := s.get(config)
+		if s.Secret && value != "" {
+			fmt.Fprintf(w, "# %s = ********\n", s.Key)
+		} else {
+			fmt.Fprintf(w, "%s = %s\n", s.Key, value)
 		}
 	}
 
-	log.Printf("Loaded configuration from: %s", configPath)
-	return config
-}
+	for _, p := range []struct {
+		section  string
+		settings []hostPatternSetting
+	}{
+		{"ct_hosts", config.CTHostModes},
+		{"cert_faults", config.CertFaults},
+		{"dns_hosts", config.DNSHosts},
+	} {
+		fmt.Fprintf(w, "\n[%s]\n", p.section)
+		for _, setting := range p.settings {
+			fmt.Fprintf(w, "%s = %s\n", setting.Pattern, setting.Value)
+		}
+	}
 
-func parseInt(s string) (int, error) {
-	var result int
-	_, err := fmt.Sscanf(s, "%d", &result)
-	return result, err
+	dumpModules(w, config)
 }
 
-func parseBool(s string) bool {
-	s = strings.ToLower(s)
-	return s == "true" || s == "yes" || s == "1" || s == "on"
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "1", "on":
+		return true, nil
+	case "false", "no", "0", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean (use true or false)", s)
 }
 
 func initCA(config *ProxyConfig) error {
+	if currentConfig().ImportP12 != "" || currentConfig().ImportCert != "" {
+		return importCA()
+	}
+
 	certPath := filepath.Join(config.CertDir, caCertFile)
 	keyPath := filepath.Join(config.CertDir, caKeyFile)
 
+	if currentConfig().UseIntermediate {
+		return initIntermediateCA(config, certPath, keyPath)
+	}
+
 	if fileExists(certPath) && fileExists(keyPath) {
 		return loadCA(certPath, keyPath)
 	}
@@ -2390,6 +10535,7 @@ func initCA(config *ProxyConfig) error {
 }
 
 func generateCA(certPath, keyPath string, skipInstall bool) error {
+	cfg := currentConfig()
 	log.Println("Generating new CA certificate...")
 
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -2405,11 +10551,11 @@ func generateCA(certPath, keyPath string, skipInstall bool) error {
 	template := &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{certConfig.Organization},
-			CommonName:   certConfig.CommonName,
+			Organization: []string{cfg.Organization},
+			CommonName:   cfg.CommonName,
 		},
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(certConfig.ValidityYears, 0, 0),
+		NotAfter:              time.Now().AddDate(cfg.ValidityYears, 0, 0),
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -2417,13 +10563,13 @@ func generateCA(certPath, keyPath string, skipInstall bool) error {
 		MaxPathLen:            1,
 	}
 
-	if len(certConfig.CRLDistPoints) > 0 {
-		template.CRLDistributionPoints = certConfig.CRLDistPoints
-		log.Printf("CA CRL Distribution Points: %v", certConfig.CRLDistPoints)
+	if len(cfg.CRLDistPoints) > 0 {
+		template.CRLDistributionPoints = cfg.CRLDistPoints
+		log.Printf("CA CRL Distribution Points: %v", cfg.CRLDistPoints)
 	}
 
-	if certConfig.AIAURLs != "" {
-		parts := strings.Split(certConfig.AIAURLs, "|")
+	if cfg.AIAURLs != "" {
+		parts := strings.Split(cfg.AIAURLs, "|")
 		if len(parts) == 2 {
 			ocspURL := strings.TrimSpace(parts[0])
 			caIssuerURL := strings.TrimSpace(parts[1])
@@ -2437,9 +10583,9 @@ func generateCA(certPath, keyPath string, skipInstall bool) error {
 				log.Printf("CA Issuer URL: %s", caIssuerURL)
 			}
 		}
-	} else if certConfig.OCSPServer != "" {
-		template.OCSPServer = []string{certConfig.OCSPServer}
-		log.Printf("CA OCSP Server: %s", certConfig.OCSPServer)
+	} else if cfg.OCSPServer != "" {
+		template.OCSPServer = []string{cfg.OCSPServer}
+		log.Printf("CA OCSP Server: %s", cfg.OCSPServer)
 	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
@@ -2462,9 +10608,9 @@ func generateCA(certPath, keyPath string, skipInstall bool) error {
 	keyOut.Close()
 
 	log.Printf("CA certificate generated: %s", certPath)
-	log.Printf("CA Organization: %s", certConfig.Organization)
-	log.Printf("CA Common Name: %s", certConfig.CommonName)
-	log.Printf("CA Validity: %d years", certConfig.ValidityYears)
+	log.Printf("CA Organization: %s", cfg.Organization)
+	log.Printf("CA Common Name: %s", cfg.CommonName)
+	log.Printf("CA Validity: %d years", cfg.ValidityYears)
 
 	if skipInstall {
 		log.Println("Skipping automatic certificate installation (--skip-install flag)")
@@ -2484,50 +10630,465 @@ func generateCA(certPath, keyPath string, skipInstall bool) error {
 }
 
 func loadCA(certPath, keyPath string) error {
-	certPEM, err := os.ReadFile(certPath)
+	cert, err := loadCertPEM(certPath)
+	if err != nil {
+		return err
+	}
+
+	key, err := loadKeyPEM(keyPath)
+	if err != nil {
+		return err
+	}
+
+	setCA(cert, key, []*x509.Certificate{cert})
+
+	log.Println("Loaded existing CA certificate")
+	return nil
+}
+
+func loadCertPEM(path string) (*x509.Certificate, error) {
+	certs, err := loadCertChainPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func loadCertChainPEM(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	return certs, nil
+}
+
+func loadKeyPEM(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode key PEM")
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return parsePrivateKey(block.Bytes)
+		}
+	}
+}
+
+// parsePrivateKey accepts PKCS#1, PKCS#8 and SEC 1 encoded keys, which
+// covers what openssl and most CA tooling write out.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key format: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func marshalPrivateKeyPEM(key crypto.Signer) (*pem.Block, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+// chainDER returns the certificates served after a leaf: the signing CA
+// followed by its issuers up to the root.
+func (ca *signingCA) chainDER() [][]byte {
+	chain := make([][]byte, 0, len(ca.chain))
+	for _, cert := range ca.chain {
+		chain = append(chain, cert.Raw)
+	}
+	return chain
+}
+
+// caRootCert is the trust anchor clients need to install.
+func caRootCert() *x509.Certificate {
+	ca := currentCA()
+	if len(ca.chain) == 0 {
+		return ca.cert
+	}
+	return ca.chain[len(ca.chain)-1]
+}
+
+// ============================================================================
+// INTERMEDIATE CA AND IMPORTED CA
+// ============================================================================
+
+const (
+	intermediateCertFile = "proxy-intermediate.crt"
+	intermediateKeyFile  = "proxy-intermediate.key"
+)
+
+// initIntermediateCA signs leaves with a short-lived intermediate. The root
+// key is only needed when the intermediate has to be (re)issued, so it can
+// be kept offline the rest of the time.
+func initIntermediateCA(config *ProxyConfig, rootCertPath, rootKeyPath string) error {
+	if !fileExists(rootCertPath) {
+		if err := generateCA(rootCertPath, rootKeyPath, config.SkipInstall); err != nil {
+			return err
+		}
+	}
+
+	root, err := loadCertPEM(rootCertPath)
+	if err != nil {
+		return err
+	}
+
+	intCertPath := filepath.Join(config.CertDir, intermediateCertFile)
+	intKeyPath := filepath.Join(config.CertDir, intermediateKeyFile)
+
+	if fileExists(intCertPath) && fileExists(intKeyPath) {
+		cert, certErr := loadCertPEM(intCertPath)
+		key, keyErr := loadKeyPEM(intKeyPath)
+		if certErr == nil && keyErr == nil && cert.CheckSignatureFrom(root) == nil &&
+			time.Until(cert.NotAfter) > intermediateRenewalWindow(cert) {
+			setCA(cert, key, []*x509.Certificate{cert, root})
+			log.Printf("Loaded intermediate CA (expires %s)", cert.NotAfter.Format(time.RFC3339))
+			return nil
+		}
+		log.Println("Intermediate CA is missing, expired or not issued by the root - re-issuing")
+	}
+
+	if !fileExists(rootKeyPath) {
+		return fmt.Errorf("root key %s is offline - restore it to issue a new intermediate", rootKeyPath)
+	}
+	rootKey, err := loadKeyPEM(rootKeyPath)
+	if err != nil {
+		return err
+	}
+
+	return generateIntermediate(root, rootKey, intCertPath, intKeyPath)
+}
+
+// intermediateCheckInterval is how often a running proxy checks whether the
+// intermediate has entered its renewal window.
+const intermediateCheckInterval = time.Hour
+
+// watchIntermediateCA re-issues the intermediate while the proxy runs, so a
+// long-lived process never keeps signing with an expiring CA.
+func watchIntermediateCA(config *ProxyConfig) {
+	for range time.Tick(intermediateCheckInterval) {
+		renewIntermediateCA(config)
+	}
+}
+
+// renewIntermediateCA re-issues the intermediate once it is inside its
+// renewal window and flushes the leaves it signed.
+func renewIntermediateCA(config *ProxyConfig) {
+	ca := currentCA()
+	if time.Until(ca.cert.NotAfter) > intermediateRenewalWindow(ca.cert) {
+		return
+	}
+
+	rootKeyPath := filepath.Join(config.CertDir, caKeyFile)
+	if !fileExists(rootKeyPath) {
+		log.Printf("WARNING: Intermediate CA expires %s and the root key %s is offline - restore it to re-issue",
+			ca.cert.NotAfter.Format(time.RFC3339), rootKeyPath)
+		return
+	}
+	root, err := loadCertPEM(filepath.Join(config.CertDir, caCertFile))
+	if err != nil {
+		log.Printf("WARNING: Cannot re-issue intermediate CA: %v", err)
+		return
+	}
+	rootKey, err := loadKeyPEM(rootKeyPath)
+	if err != nil {
+		log.Printf("WARNING: Cannot re-issue intermediate CA: %v", err)
+		return
+	}
+
+	intCertPath := filepath.Join(config.CertDir, intermediateCertFile)
+	intKeyPath := filepath.Join(config.CertDir, intermediateKeyFile)
+	if err := generateIntermediate(root, rootKey, intCertPath, intKeyPath); err != nil {
+		log.Printf("WARNING: Failed to re-issue intermediate CA: %v", err)
+		return
+	}
+	certCache.Flush()
+	log.Println("[CERTCACHE] Flushed host certificates signed by the previous intermediate")
+}
+
+// intermediateRenewalWindow re-issues the intermediate once less than a
+// tenth of its lifetime remains.
+func intermediateRenewalWindow(cert *x509.Certificate) time.Duration {
+	return cert.NotAfter.Sub(cert.NotBefore) / 10
+}
+
+func generateIntermediate(root *x509.Certificate, rootKey crypto.Signer, certPath, keyPath string) error {
+	cfg := currentConfig()
+	log.Println("Generating new intermediate CA certificate...")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
 		return err
 	}
 
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return fmt.Errorf("failed to decode certificate PEM")
+	notAfter := time.Now().AddDate(0, 0, cfg.IntermediateValidityDays)
+	if notAfter.After(root.NotAfter) {
+		notAfter = root.NotAfter
+	}
+
+	commonName := cfg.IntermediateCommonName
+	if commonName == "" {
+		commonName = cfg.CommonName + " Intermediate"
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{cfg.Organization},
+			CommonName:   commonName,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
 	}
 
-	caCert, err = x509.ParseCertificate(block.Bytes)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey)
 	if err != nil {
 		return err
 	}
 
-	keyPEM, err := os.ReadFile(keyPath)
+	certOut, err := os.Create(certPath)
 	if err != nil {
 		return err
 	}
+	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	certOut.Close()
 
-	block, _ = pem.Decode(keyPEM)
-	if block == nil {
-		return fmt.Errorf("failed to decode key PEM")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		return err
 	}
 
-	caKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	cert, err := x509.ParseCertificate(certDER)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Loaded existing CA certificate")
+	setCA(cert, key, []*x509.Certificate{cert, root})
+
+	log.Printf("Intermediate CA generated: %s", certPath)
+	log.Printf("Intermediate Common Name: %s", commonName)
+	log.Printf("Intermediate valid until: %s", notAfter.Format(time.RFC3339))
+	log.Println("The root key is no longer needed until the intermediate expires and can be moved offline")
+	return nil
+}
+
+// importCA uses an existing CA instead of generating one. The certificate
+// matching the private key signs leaves; any other certificates supplied are
+// treated as its issuers and served with every leaf.
+func importCA() error {
+	cfg := currentConfig()
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	var err error
+
+	if cfg.ImportP12 != "" {
+		certs, key, err = loadPKCS12(cfg.ImportP12, cfg.ImportP12Password)
+	} else {
+		if cfg.ImportKey == "" {
+			return fmt.Errorf("import_cert requires import_key")
+		}
+		certs, err = loadCertChainPEM(cfg.ImportCert)
+		if err == nil {
+			key, err = loadKeyPEM(cfg.ImportKey)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import CA: %v", err)
+	}
+
+	chain, err := orderCAChain(certs, key)
+	if err != nil {
+		return fmt.Errorf("failed to import CA: %v", err)
+	}
+
+	setCA(chain[0], key, chain)
+
+	log.Printf("Imported CA: %s", chain[0].Subject.CommonName)
+	if len(chain) > 1 {
+		log.Printf("Imported chain: %d certificates, root %s", len(chain), caRootCert().Subject.CommonName)
+	}
+	log.Println("Imported CAs are not installed automatically - make sure the root is trusted by your clients")
 	return nil
 }
 
+// orderCAChain puts the certificate matching key first and follows issuer
+// links through the remaining certificates.
+func orderCAChain(certs []*x509.Certificate, key crypto.Signer) ([]*x509.Certificate, error) {
+	type publicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+
+	var signing *x509.Certificate
+	for _, cert := range certs {
+		if pub, ok := key.Public().(publicKey); ok && pub.Equal(cert.PublicKey) {
+			signing = cert
+			break
+		}
+	}
+	if signing == nil {
+		return nil, fmt.Errorf("no certificate matches the private key")
+	}
+	if !signing.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", signing.Subject.CommonName)
+	}
+
+	chain := []*x509.Certificate{signing}
+	current := signing
+	for len(chain) <= len(certs) {
+		if bytes.Equal(current.RawIssuer, current.RawSubject) {
+			break
+		}
+		var issuer *x509.Certificate
+		for _, cert := range certs {
+			if cert != current && current.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		current = issuer
+	}
+	return chain, nil
+}
+
+// loadPKCS12 converts a PKCS#12 bundle with openssl, the same way the trust
+// store helpers shell out to platform tools. The password is passed through
+// the environment so it doesn't show up in the process list.
+func loadPKCS12(path, password string) ([]*x509.Certificate, crypto.Signer, error) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		return nil, nil, fmt.Errorf("openssl not found in PATH - convert %s to PEM and use import_cert/import_key", path)
+	}
+	if password == "" {
+		password = os.Getenv("TLSPROXY_P12_PASSWORD")
+	}
+
+	run := func(extra ...string) ([]byte, error) {
+		args := append([]string{"pkcs12", "-in", path, "-nodes", "-passin", "env:TLSPROXY_P12_PASSWORD"}, extra...)
+		cmd := exec.Command("openssl", args...)
+		cmd.Env = append(os.Environ(), "TLSPROXY_P12_PASSWORD="+password)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("openssl pkcs12 failed: %v - %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return output, nil
+	}
+
+	output, err := run()
+	if err != nil {
+		// OpenSSL 3 refuses RC2/3DES bundles unless the legacy provider is loaded
+		if legacy, legacyErr := run("-legacy"); legacyErr == nil {
+			output, err = legacy, nil
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	for {
+		var block *pem.Block
+		block, output = pem.Decode(output)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if key, err = parsePrivateKey(block.Bytes); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if len(certs) == 0 || key == nil {
+		return nil, nil, fmt.Errorf("%s does not contain a certificate and private key", path)
+	}
+	return certs, key, nil
+}
+
 func cleanupCerts(config *ProxyConfig) {
 	certPath := filepath.Join(config.CertDir, caCertFile)
 	keyPath := filepath.Join(config.CertDir, caKeyFile)
 
-	log.Println("Removing certificate from system trust store...")
-	if err := uninstallCertificate(); err != nil {
-		log.Printf("WARNING: Failed to uninstall certificate: %v", err)
-		log.Println("You may need to remove it manually")
-	} else {
-		log.Println("Certificate uninstalled from system")
+	// Everything in the install record, plus the current CA in case it was
+	// installed before records were kept
+	cas := recordedCAs()
+	if cert, err := loadCertPEM(certPath); err == nil && !containsCert(cas, cert) {
+		cas = append(cas, cert)
+	}
+	for _, ca := range cas {
+		log.Printf("Removing %s (SHA-256 %s) from trust stores...", ca.Subject.CommonName, certFingerprintColons(ca, crypto.SHA256))
+		if err := uninstallCert(ca); err != nil {
+			log.Printf("WARNING: Failed to uninstall certificate: %v", err)
+			log.Println("You may need to remove it manually")
+		}
+	}
+
+	if currentConfig().TrustDryRun {
+		log.Println("Dry run: leaving certificate files in place")
+		return
 	}
 
 	removed := false
@@ -2541,6 +11102,18 @@ func cleanupCerts(config *ProxyConfig) {
 		log.Printf("Removed: %s", keyPath)
 		removed = true
 	}
+	for _, name := range []string{intermediateCertFile, intermediateKeyFile} {
+		if path := filepath.Join(config.CertDir, name); fileExists(path) {
+			os.Remove(path)
+			log.Printf("Removed: %s", path)
+			removed = true
+		}
+	}
+	if hostDir := filepath.Join(config.CertDir, hostCertDir); fileExists(hostDir) {
+		os.RemoveAll(hostDir)
+		log.Printf("Removed: %s", hostDir)
+		removed = true
+	}
 	if !removed {
 		log.Println("No certificate files found to remove")
 	}
@@ -2565,6 +11138,14 @@ func handleConnection(clientConn net.Conn, config *ProxyConfig) {
 		return
 	}
 
+	if !proxyAuthorized(req) {
+		log.Printf("[AUTH] Proxy authentication required for %s", clientAddr)
+		rejectProxyAuth(clientConn)
+		return
+	}
+	// The credentials are for us, not for the upstream or the logs
+	req.Header.Del("Proxy-Authorization")
+
 	if req.Method == http.MethodConnect {
 		log.Printf("[CONNECT] %s -> %s", clientAddr, req.Host)
 		handleConnect(clientConn, req, config)
@@ -2579,10 +11160,35 @@ func handleConnect(clientConn net.Conn, req *http.Request, config *ProxyConfig)
 	if !strings.Contains(host, ":") {
 		host = host + ":443"
 	}
+	hostname := strings.Split(host, ":")[0]
 
+	if refuseConnect(clientConn, req, hostname) {
+		return
+	}
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	cert := getCertForHost(host)
+	clientAddr := clientConn.RemoteAddr().String()
+	faults := certFaultsFor(hostname)
+
+	if profile := networkProfile(hostname, true); profile != nil && profile.failHandshake() {
+		log.Printf("[NETWORK] %s: failing TLS handshake with %s", profile.name, host)
+		clientConn.Write(tlsHandshakeFailureAlert)
+		return
+	}
+	clientConn = shapeConn(clientConn, hostname)
+
+	cert, err := getCertForHost(host)
+	if err != nil {
+		log.Printf("[CERT] No certificate for %s: %v", hostname, err)
+		clientConn.Write(tlsHandshakeFailureAlert)
+		return
+	}
+	if currentConfig().OCSPStapling {
+		stapled := *cert
+		stapled.OCSPStaple = revocations.Staple(cert.Leaf)
+		cert = &stapled
+	}
+
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{*cert},
 		MinVersion:   tls.VersionTLS12,
@@ -2612,6 +11218,10 @@ func handleConnect(clientConn net.Conn, req *http.Request, config *ProxyConfig)
 
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
 	if err := tlsClientConn.Handshake(); err != nil {
+		if len(faults) > 0 {
+			certFaultLog.Record(hostname, clientAddr, faults, false, err.Error())
+		}
+
 		errMsg := err.Error()
 		if strings.Contains(errMsg, "tls: client offered only unsupported versions") {
 			log.Printf("[TLS] Client using unsupported TLS version for %s", host)
@@ -2636,10 +11246,18 @@ func handleConnect(clientConn net.Conn, req *http.Request, config *ProxyConfig)
 	}
 	log.Printf("[TLS] %s using %s with cipher %s", host, tlsVersion, tls.CipherSuiteName(state.CipherSuite))
 
+	// A faulty certificate counts as accepted once the client sends a request
+	// over the connection
+	faultPending := len(faults) > 0
+
 	reader := bufio.NewReader(tlsClientConn)
 	for {
 		req, err := http.ReadRequest(reader)
 		if err != nil {
+			if faultPending {
+				certFaultLog.Record(hostname, clientAddr, faults, false, "handshake completed but no request was sent")
+			}
+
 			if err == io.EOF {
 				return
 			}
@@ -2660,26 +11278,17 @@ func handleConnect(clientConn net.Conn, req *http.Request, config *ProxyConfig)
 			return
 		}
 
+		if faultPending {
+			certFaultLog.Record(hostname, clientAddr, faults, true, "")
+			faultPending = false
+		}
+
 		req.URL.Scheme = "https"
 		req.URL.Host = req.Host
 
-		logRequest(req, config)
-
-		resp, err := forwardRequest(req)
-		if err != nil {
-			log.Printf("Failed to forward request: %v", err)
-			tlsClientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
-			return
-		}
-
-		if err := resp.Write(tlsClientConn); err != nil {
-			if err != io.EOF && !strings.Contains(err.Error(), "broken pipe") {
-				log.Printf("Failed to write response: %v", err)
-			}
-			resp.Body.Close()
+		if !serveExchange(tlsClientConn, newExchange(req, clientAddr, &state), config) {
 			return
 		}
-		resp.Body.Close()
 	}
 }
 
@@ -2696,17 +11305,13 @@ func handleHTTP(clientConn net.Conn, req *http.Request, config *ProxyConfig) {
 		req.URL.Host = req.Host
 	}
 
-	logRequest(req, config)
-
-	resp, err := forwardRequest(req)
-	if err != nil {
-		log.Printf("Failed to forward HTTP request: %v", err)
-		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
-		return
+	// The request line is already read; only the body and the response
+	// are shaped
+	shaped := shapeConn(clientConn, req.URL.Hostname())
+	if sc, ok := shaped.(*shapedConn); ok && req.Body != nil {
+		req.Body = &shapedBody{req.Body, sc}
 	}
-	defer resp.Body.Close()
-
-	resp.Write(clientConn)
+	serveExchange(shaped, newExchange(req, clientConn.RemoteAddr().String(), nil), config)
 }
 
 func forwardRequest(req *http.Request) (*http.Response, error) {
@@ -2735,8 +11340,9 @@ func forwardRequest(req *http.Request) (*http.Response, error) {
 	}
 
 	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
-		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       dialUpstream,
 		ForceAttemptHTTP2: false,
 	}
 
@@ -2759,24 +11365,19 @@ func forwardRequest(req *http.Request) (*http.Response, error) {
 
 	outReq.RequestURI = ""
 	outReq.Header.Del("Proxy-Connection")
+	outReq = outReq.WithContext(req.Context())
 
 	resp, err := client.Do(outReq)
 	if err != nil {
 		return nil, err
 	}
 
-	executeModulesResponse(resp)
+	recordUpstreamChain(req.URL.Hostname(), resp.TLS)
 
 	return resp, nil
 }
 
 func logRequest(req *http.Request, config *ProxyConfig) {
-	shouldLog := executeModules(req)
-
-	if !shouldLog {
-		return
-	}
-
 	logMutex.Lock()
 	defer logMutex.Unlock()
 
@@ -2840,7 +11441,7 @@ func logRequest(req *http.Request, config *ProxyConfig) {
 		}
 	}
 
-	if verboseMode {
+	if currentConfig().Verbose {
 		consoleEntry := sanitizeForConsole(logEntry)
 		fmt.Print(consoleEntry)
 	}
@@ -2848,36 +11449,449 @@ func logRequest(req *http.Request, config *ProxyConfig) {
 	logWriter.WriteString(logEntry)
 }
 
-func getCertForHost(host string) *tls.Certificate {
+func getCertForHost(host string) (*tls.Certificate, error) {
 	hostname := strings.Split(host, ":")[0]
 
+	// Hits only need the read lock; generation runs outside any lock so a
+	// slow hostname never blocks unrelated ones.
 	certCache.RLock()
-	cert, exists := certCache.certs[hostname]
+	entry, exists := certCache.certs[hostname]
+	if exists && !certCache.needsRenewal(entry) {
+		certCache.RUnlock()
+		certCache.touch(entry)
+		certCache.hits.Add(1)
+		return entry.cert, nil
+	}
 	certCache.RUnlock()
 
-	if exists {
-		return cert
+	certCache.Lock()
+	if entry, exists := certCache.certs[hostname]; exists {
+		if !certCache.needsRenewal(entry) {
+			certCache.Unlock()
+			certCache.hits.Add(1)
+			return entry.cert, nil
+		}
+		log.Printf("[CERTCACHE] Renewing certificate for %s (expires %s)", hostname, entry.leaf.NotAfter.Format(time.RFC3339))
+		certCache.removeLocked(hostname)
+		certCache.renewals.Add(1)
+	}
+	if call, ok := certCache.inflight[hostname]; ok {
+		certCache.Unlock()
+		<-call.done
+		certCache.shared.Add(1)
+		return call.cert, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	certCache.inflight[hostname] = call
+	certCache.Unlock()
+
+	certCache.misses.Add(1)
+	var evicted []string
+	var faulty bool
+	func() {
+		// Release the in-flight entry even if generation panics; the panic
+		// becomes an error for this caller and every waiter.
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("[CERTCACHE] Certificate generation for %s panicked: %v\n%s", hostname, r, debug.Stack())
+				call.cert, call.err = nil, fmt.Errorf("certificate generation panicked: %v", r)
+			}
+			certCache.Lock()
+			if call.err == nil {
+				evicted = certCache.addLocked(hostname, call.cert, time.Now(), faulty)
+			}
+			delete(certCache.inflight, hostname)
+			certCache.Unlock()
+			close(call.done)
+		}()
+		start := time.Now()
+		call.cert, faulty, call.err = generateCertForHost(hostname, upstreamLeafFor(host))
+		certCache.recordGeneration(time.Since(start))
+	}()
+	if call.err != nil {
+		return nil, call.err
 	}
 
-	certCache.Lock()
-	defer certCache.Unlock()
+	saved := call.cert
+	if faulty {
+		saved = nil
+	}
+	certCache.persist(hostname, saved, evicted)
+
+	return call.cert, nil
+}
+
+// addLocked inserts a leaf at the front of the LRU list and returns the
+// hostnames evicted to stay within maxEntries. faulty records whether the
+// leaf was minted with cert faults. A cert without a parseable leaf is
+// never cached. The caller holds the lock.
+func (c *CertCache) addLocked(hostname string, cert *tls.Certificate, lastUsed time.Time, faulty bool) []string {
+	if cert.Leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return nil
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+		cert.Leaf = leaf
+	}
+
+	entry := &cachedCert{
+		hostname:      hostname,
+		cert:          cert,
+		leaf:          cert.Leaf,
+		caFingerprint: currentCA().hash,
+		lastUsed:      lastUsed,
+		faulty:        faulty,
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.certs[hostname] = entry
+
+	var evicted []string
+	for c.maxEntries > 0 && len(c.certs) > c.maxEntries {
+		oldest := c.lru.Back().Value.(*cachedCert)
+		c.removeLocked(oldest.hostname)
+		c.evictions.Add(1)
+		evicted = append(evicted, oldest.hostname)
+	}
+	return evicted
+}
+
+// touch moves a hit to the front of the LRU list. It is skipped while the
+// write lock is busy; recency only has to be approximate.
+func (c *CertCache) touch(entry *cachedCert) {
+	if !c.TryLock() {
+		return
+	}
+	if c.certs[entry.hostname] == entry {
+		entry.lastUsed = time.Now()
+		c.lru.MoveToFront(entry.element)
+	}
+	c.Unlock()
+}
+
+// Lookup returns the cached leaf for hostname without touching the LRU.
+func (c *CertCache) Lookup(hostname string) *x509.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	if entry, ok := c.certs[hostname]; ok {
+		return entry.leaf
+	}
+	return nil
+}
+
+func (c *CertCache) Invalidate(hostname string) {
+	c.Lock()
+	c.removeLocked(hostname)
+	c.Unlock()
+}
+
+func (c *CertCache) removeLocked(hostname string) {
+	if entry, ok := c.certs[hostname]; ok {
+		c.lru.Remove(entry.element)
+		delete(c.certs, hostname)
+	}
+}
+
+// needsRenewal reports whether a cached leaf is close to NotAfter or was
+// signed by a CA other than the one currently loaded.
+func (c *CertCache) needsRenewal(entry *cachedCert) bool {
+	if entry.leaf == nil {
+		return true
+	}
+	ca := currentCA()
+	if entry.caFingerprint != ca.hash {
+		return true
+	}
+	if entry.faulty {
+		return false
+	}
+	return leafExpiring(entry.leaf, ca)
+}
+
+// leafExpiring reports whether a leaf is within renew_before_days of
+// NotAfter. A leaf cut short by the CA's own expiry can't be re-minted any
+// longer, so it is kept until the CA is re-issued.
+func leafExpiring(leaf *x509.Certificate, ca *signingCA) bool {
+	if !leaf.NotAfter.Before(ca.cert.NotAfter) {
+		return false
+	}
+	return time.Until(leaf.NotAfter) < renewalWindow()
+}
+
+func renewalWindow() time.Duration {
+	cfg := currentConfig()
+	days := cfg.RenewBeforeDays
+	if days*2 > cfg.HostValidityDays {
+		days = cfg.HostValidityDays / 2
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Flush drops every cached leaf, in memory and on disk.
+func (c *CertCache) Flush() {
+	c.Lock()
+	c.certs = make(map[string]*cachedCert)
+	c.lru.Init()
+	c.Unlock()
+
+	if c.dir != "" {
+		c.diskMu.Lock()
+		os.RemoveAll(c.dir)
+		os.MkdirAll(c.dir, 0700)
+		c.diskMu.Unlock()
+	}
+}
+
+func (c *CertCache) recordGeneration(d time.Duration) {
+	c.generated.Add(1)
+	c.genTimeTotal.Add(int64(d))
+	for {
+		max := c.genTimeMax.Load()
+		if int64(d) <= max || c.genTimeMax.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (c *CertCache) Stats() map[string]interface{} {
+	c.RLock()
+	cached := len(c.certs)
+	pending := len(c.inflight)
+	c.RUnlock()
+
+	generated := c.generated.Load()
+	avgMs := 0.0
+	if generated > 0 {
+		avgMs = float64(c.genTimeTotal.Load()) / float64(generated) / float64(time.Millisecond)
+	}
+
+	stats := map[string]interface{}{
+		"cached":       cached,
+		"pending":      pending,
+		"maxEntries":   c.maxEntries,
+		"diskCache":    c.dir != "",
+		"hits":         c.hits.Load(),
+		"misses":       c.misses.Load(),
+		"shared":       c.shared.Load(),
+		"renewals":     c.renewals.Load(),
+		"evictions":    c.evictions.Load(),
+		"generated":    generated,
+		"avgGenTimeMs": avgMs,
+		"maxGenTimeMs": float64(c.genTimeMax.Load()) / float64(time.Millisecond),
+		"keyPool":      leafKeyPool.Stats(),
+	}
+	return stats
+}
+
+// ============================================================================
+// HOST CERTIFICATE DISK CACHE
+// ============================================================================
+
+const (
+	hostCertDir       = "host-certs"
+	hostCertIndexFile = "index.json"
+)
+
+type certIndexEntry struct {
+	File          string    `json:"file"`
+	NotAfter      time.Time `json:"notAfter"`
+	CAFingerprint string    `json:"caFingerprint"`
+	LastUsed      time.Time `json:"lastUsed"`
+}
+
+// EnableDiskCache stores leaves as PEM files under dir and loads the ones
+// still valid for the current CA. Stale files are removed.
+func (c *CertCache) EnableDiskCache(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	index := make(map[string]certIndexEntry)
+	if data, err := os.ReadFile(filepath.Join(dir, hostCertIndexFile)); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			log.Printf("[CERTCACHE] Ignoring corrupt index: %v", err)
+		}
+	}
+
+	hostnames := make([]string, 0, len(index))
+	for hostname := range index {
+		hostnames = append(hostnames, hostname)
+	}
+	// Oldest first, so the most recently used ends up at the LRU front
+	sort.Slice(hostnames, func(i, j int) bool {
+		return index[hostnames[i]].LastUsed.Before(index[hostnames[j]].LastUsed)
+	})
+
+	c.Lock()
+	c.dir = dir
+	loaded, stale := 0, 0
+	var evicted []string
+	for _, hostname := range hostnames {
+		meta := index[hostname]
+		// The file name is derived, never taken from the index, so a
+		// crafted index can't point outside the cache directory
+		path := filepath.Join(dir, hostCertFileName(hostname))
+		cert, err := loadHostCert(path)
+		// Hosts that now have cert faults must be re-minted with them
+		if err != nil || cert.Leaf.CheckSignatureFrom(currentCA().cert) != nil ||
+			time.Until(cert.Leaf.NotAfter) <= 0 || leafExpiring(cert.Leaf, currentCA()) ||
+			len(certFaultsFor(hostname)) > 0 {
+			os.Remove(path)
+			stale++
+			continue
+		}
+		evicted = append(evicted, c.addLocked(hostname, cert, meta.LastUsed, false)...)
+		loaded++
+	}
+	c.Unlock()
 
-	if cert, exists := certCache.certs[hostname]; exists {
-		return cert
+	for _, hostname := range evicted {
+		os.Remove(filepath.Join(dir, hostCertFileName(hostname)))
 	}
+	c.saveIndex()
 
-	cert = generateCertForHost(hostname)
-	certCache.certs[hostname] = cert
-	return cert
+	log.Printf("[CERTCACHE] Disk cache %s: loaded %d, discarded %d stale", dir, loaded, stale)
+	return nil
+}
+
+// persist writes a newly minted leaf (unless cert is nil) and drops evicted
+// ones when the disk cache is enabled.
+func (c *CertCache) persist(hostname string, cert *tls.Certificate, evicted []string) {
+	if c.dir == "" {
+		return
+	}
+
+	c.diskMu.Lock()
+	if cert != nil {
+		if err := saveHostCert(filepath.Join(c.dir, hostCertFileName(hostname)), cert); err != nil {
+			log.Printf("[CERTCACHE] Failed to save certificate for %s: %v", hostname, err)
+		}
+	}
+	for _, old := range evicted {
+		os.Remove(filepath.Join(c.dir, hostCertFileName(old)))
+	}
+	c.diskMu.Unlock()
+
+	c.saveIndex()
+}
+
+func (c *CertCache) saveIndex() {
+	if c.dir == "" {
+		return
+	}
+
+	c.RLock()
+	index := make(map[string]certIndexEntry, len(c.certs))
+	for hostname, entry := range c.certs {
+		if entry.faulty {
+			continue
+		}
+		index[hostname] = certIndexEntry{
+			File:          hostCertFileName(hostname),
+			NotAfter:      entry.leaf.NotAfter,
+			CAFingerprint: entry.caFingerprint,
+			LastUsed:      entry.lastUsed,
+		}
+	}
+	c.RUnlock()
+
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return
+	}
+
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+	if err := os.WriteFile(filepath.Join(c.dir, hostCertIndexFile), data, 0600); err != nil {
+		log.Printf("[CERTCACHE] Failed to write index: %v", err)
+	}
+}
+
+func hostCertFileName(hostname string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, hostname)
+	return safe + ".pem"
+}
+
+func saveHostCert(path string, cert *tls.Certificate) error {
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	pem.Encode(&buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func loadHostCert(path string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// signingCA is the CA that signs leaves, with the chain served after them.
+// It is swapped as a whole when the intermediate is re-issued.
+type signingCA struct {
+	cert  *x509.Certificate
+	key   crypto.Signer
+	chain []*x509.Certificate
+	// hash is certFingerprint(cert), which the cert cache compares
+	// against on every hit
+	hash string
+}
+
+var activeCA atomic.Pointer[signingCA]
+
+func currentCA() *signingCA {
+	return activeCA.Load()
+}
+
+// setCA installs the signing CA and precomputes its fingerprint.
+func setCA(cert *x509.Certificate, key crypto.Signer, chain []*x509.Certificate) {
+	activeCA.Store(&signingCA{cert: cert, key: key, chain: chain, hash: certFingerprint(cert)})
 }
 
-func generateCertForHost(hostname string) *tls.Certificate {
+func certFingerprint(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// generateCertForHost mints a leaf for hostname and reports whether any
+// cert faults were applied to it.
+func generateCertForHost(hostname string, upstream *x509.Certificate) (*tls.Certificate, bool, error) {
+	cfg := currentConfig()
 	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 
 	sanDNSNames := []string{hostname}
 	sanIPAddresses := []net.IP{}
 
-	for _, san := range certConfig.DefaultSANs {
+	for _, san := range cfg.DefaultSANs {
 		if ip := net.ParseIP(san); ip != nil {
 			sanIPAddresses = append(sanIPAddresses, ip)
 		} else {
@@ -2907,24 +11921,33 @@ func generateCertForHost(hostname string) *tls.Certificate {
 	template := &x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{certConfig.Organization},
+			Organization: []string{cfg.Organization},
 			CommonName:   hostname,
 		},
 		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(0, 0, certConfig.HostValidityDays),
+		NotAfter:    time.Now().AddDate(0, 0, cfg.HostValidityDays),
 		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		DNSNames:    sanDNSNames,
 		IPAddresses: sanIPAddresses,
 	}
 
-	if certConfig.IncludeCDPInHosts && len(certConfig.CRLDistPoints) > 0 {
-		template.CRLDistributionPoints = certConfig.CRLDistPoints
+	if upstream != nil {
+		applyUpstreamProfile(template, upstream)
+	}
+
+	// A leaf must not outlive the CA that signed it
+	if ca := currentCA(); template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	if cfg.IncludeCDPInHosts && len(cfg.CRLDistPoints) > 0 {
+		template.CRLDistributionPoints = cfg.CRLDistPoints
 	}
 
-	if certConfig.IncludeAIAInHosts {
-		if certConfig.AIAURLs != "" {
-			parts := strings.Split(certConfig.AIAURLs, "|")
+	if cfg.IncludeAIAInHosts {
+		if cfg.AIAURLs != "" {
+			parts := strings.Split(cfg.AIAURLs, "|")
 			if len(parts) == 2 {
 				ocspURL := strings.TrimSpace(parts[0])
 				caIssuerURL := strings.TrimSpace(parts[1])
@@ -2936,20 +11959,63 @@ func generateCertForHost(hostname string) *tls.Certificate {
 					template.IssuingCertificateURL = []string{caIssuerURL}
 				}
 			}
-		} else if certConfig.OCSPServer != "" {
-			template.OCSPServer = []string{certConfig.OCSPServer}
+		} else if cfg.OCSPServer != "" {
+			template.OCSPServer = []string{cfg.OCSPServer}
+		}
+	}
+
+	// Point leaves at the built-in responder unless URLs were configured
+	if cfg.RevocationResponder {
+		base := responderBaseURL()
+		if len(template.OCSPServer) == 0 {
+			template.OCSPServer = []string{base + "/ocsp"}
+		}
+		if len(template.IssuingCertificateURL) == 0 {
+			template.IssuingCertificateURL = []string{base + "/ca.crt"}
+		}
+		if len(template.CRLDistributionPoints) == 0 {
+			template.CRLDistributionPoints = []string{base + "/crl"}
 		}
 	}
 
-	certPrivKey, _ := rsa.GenerateKey(rand.Reader, 2048)
-	certDER, _ := x509.CreateCertificate(rand.Reader, template, caCert, &certPrivKey.PublicKey, caKey)
+	faults := certFaultsFor(hostname)
+
+	var certPrivKey *rsa.PrivateKey
+	var err error
+	if hasFault(faults, faultWeakKey) {
+		certPrivKey, err = rsa.GenerateKey(rand.Reader, 1024)
+	} else {
+		certPrivKey, err = leafKeyPool.Get()
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("leaf key: %v", err)
+	}
+
+	signer := applyCertFaults(template, hostname, faults, certPrivKey)
+
+	// SCTs are signed over the precert as issued by our CA, so they only make
+	// sense when the CA is actually the issuer
+	if mode := ctModeFor(hostname); mode != ctMissing && signer.cert == currentCA().cert {
+		if err := addEmbeddedSCTs(template, &certPrivKey.PublicKey, mode, signer); err != nil {
+			log.Printf("[CT] Failed to embed SCTs for %s: %v", hostname, err)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &certPrivKey.PublicKey, signer.key)
+	if err != nil {
+		return nil, false, fmt.Errorf("signing certificate for %s: %v", hostname, err)
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, false, fmt.Errorf("parsing certificate for %s: %v", hostname, err)
+	}
 
 	cert := &tls.Certificate{
-		Certificate: [][]byte{certDER, caCert.Raw},
+		Certificate: append([][]byte{certDER}, signer.chain...),
 		PrivateKey:  certPrivKey,
+		Leaf:        leaf,
 	}
-
-	return cert
+	return cert, len(faults) > 0, nil
 }
 
 func installCertificate(certPath string) error {
@@ -2958,19 +12024,24 @@ func installCertificate(certPath string) error {
 		return err
 	}
 
+	cert, err := loadCertPEM(absPath)
+	if err != nil {
+		return err
+	}
+
 	switch runtime.GOOS {
 	case "windows":
-		return installCertWindows(absPath)
+		return installCertWindows(cert, absPath)
 	case "darwin":
-		return installCertMacOS(absPath)
+		return installCertMacOS(cert, absPath)
 	case "linux":
-		return installCertLinux(absPath)
+		return installCertLinux(cert, absPath)
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
-func installCertWindows(certPath string) error {
+func installCertWindows(cert *x509.Certificate, certPath string) error {
 	_, err := exec.LookPath("certutil")
 	if err != nil {
 		return fmt.Errorf("certutil not found in PATH - manual installation required")
@@ -2979,8 +12050,7 @@ func installCertWindows(certPath string) error {
 	log.Printf("Installing certificate to Windows trust store...")
 	log.Printf("Running: certutil -addstore -user Root \"%s\"", certPath)
 
-	cmd := exec.Command("certutil", "-addstore", "-user", "Root", certPath)
-	output, err := cmd.CombinedOutput()
+	output, err := runTrustCommand(false, "certutil", "-addstore", "-user", "Root", certPath)
 
 	if len(output) > 0 {
 		log.Printf("certutil output: %s", string(output))
@@ -2989,101 +12059,120 @@ func installCertWindows(certPath string) error {
 	if err != nil {
 		return fmt.Errorf("certutil failed: %v - %s", err, string(output))
 	}
+	if currentConfig().TrustDryRun {
+		return nil
+	}
 
 	log.Printf("Verifying certificate installation...")
-	verifyCmd := exec.Command("certutil", "-user", "-verifystore", "Root", "TLS Proxy Root CA")
-	verifyOutput, verifyErr := verifyCmd.CombinedOutput()
-
-	if verifyErr != nil {
-		log.Printf("Warning: Could not verify certificate installation: %v", verifyErr)
-		log.Printf("Verification output: %s", string(verifyOutput))
+	present, err := windowsStoreContains(cert)
+	if err != nil || !present {
+		log.Printf("Warning: Could not verify certificate installation (SHA-256 %s): %v", certFingerprintColons(cert, crypto.SHA256), err)
 		return fmt.Errorf("certificate may not be installed correctly - please check manually")
 	}
 
+	recordTrustInstall(cert, trustInstallEntry{Store: trustStoreWindows, Location: windowsRootStore})
 	log.Printf("Certificate verified in trust store")
 	return nil
 }
 
-func installCertMacOS(certPath string) error {
-	cmd := exec.Command("sudo", "security", "add-trusted-cert", "-d", "-r", "trustRoot",
-		"-k", "/Library/Keychains/System.keychain", certPath)
-	output, err := cmd.CombinedOutput()
+// windowsStoreContains looks the certificate up by thumbprint and compares
+// the exported copy, so a match means the same SHA-256 fingerprint.
+func windowsStoreContains(cert *x509.Certificate) (bool, error) {
+	dir, err := os.MkdirTemp("", "tlsproxy-verify-")
 	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+		return false, err
 	}
-	return nil
-}
-
-func installCertLinux(certPath string) error {
-	destPath := "/usr/local/share/ca-certificates/tlsproxy.crt"
+	defer os.RemoveAll(dir)
 
-	input, err := os.ReadFile(certPath)
+	exported := filepath.Join(dir, "ca.cer")
+	err = exec.Command("certutil", "-user", "-store", "Root", sha1Thumbprint(cert), exported).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	cmd := exec.Command("sudo", "tee", destPath)
-	cmd.Stdin = bytes.NewReader(input)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy certificate: %v", err)
+	data, err := os.ReadFile(exported)
+	if err != nil {
+		return false, err
 	}
-
-	cmd = exec.Command("sudo", "update-ca-certificates")
-	output, err := cmd.CombinedOutput()
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	found, err := x509.ParseCertificate(data)
 	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+		return false, err
 	}
+	return found.Equal(cert), nil
+}
 
-	return nil
+// sha1Thumbprint is the hash Windows and macOS tools use to address a
+// single certificate.
+func sha1Thumbprint(cert *x509.Certificate) string {
+	return strings.ReplaceAll(certFingerprintColons(cert, crypto.SHA1), ":", "")
 }
 
-func uninstallCertificate() error {
-	switch runtime.GOOS {
-	case "windows":
-		return uninstallCertWindows()
-	case "darwin":
-		return uninstallCertMacOS()
-	case "linux":
-		return uninstallCertLinux()
-	default:
-		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+// macKeychain is the System keychain, or the login keychain in user scope.
+func macKeychain() (keychain string, privileged bool) {
+	if currentConfig().UserTrust {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, "Library", "Keychains", "login.keychain-db"), false
 	}
+	return "/Library/Keychains/System.keychain", true
 }
 
-func uninstallCertWindows() error {
-	cmd := exec.Command("certutil", "-delstore", "-user", "Root", "TLS Proxy Root CA")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+func installCertMacOS(cert *x509.Certificate, certPath string) error {
+	keychain, privileged := macKeychain()
+
+	args := []string{"add-trusted-cert", "-r", "trustRoot", "-k", keychain, certPath}
+	if privileged {
+		// Admin trust settings (-d) are required for the System keychain
+		args = append([]string{"add-trusted-cert", "-d"}, args[1:]...)
+	}
+	if err := runTrustCommandChecked(privileged, "security", args...); err != nil {
+		return err
+	}
+	if currentConfig().TrustDryRun {
+		return nil
 	}
-	return nil
-}
 
-func uninstallCertMacOS() error {
-	cmd := exec.Command("sudo", "security", "delete-certificate", "-c", "TLS Proxy Root CA",
-		"/Library/Keychains/System.keychain")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+	present, err := macKeychainContains(cert, keychain)
+	if err != nil || !present {
+		return fmt.Errorf("certificate not found in %s after install - please check manually", keychain)
 	}
+
+	recordTrustInstall(cert, trustInstallEntry{Store: trustStoreMacOS, Location: keychain})
 	return nil
 }
 
-func uninstallCertLinux() error {
-	destPath := "/usr/local/share/ca-certificates/tlsproxy.crt"
-
-	cmd := exec.Command("sudo", "rm", "-f", destPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to remove certificate: %v", err)
+// macKeychainContains searches one keychain, or the search list when
+// keychain is empty, for the certificate's SHA-256 hash.
+func macKeychainContains(cert *x509.Certificate, keychain string) (bool, error) {
+	args := []string{"find-certificate", "-a", "-Z"}
+	if keychain != "" {
+		args = append(args, keychain)
 	}
 
-	cmd = exec.Command("sudo", "update-ca-certificates")
-	output, err := cmd.CombinedOutput()
+	output, err := exec.Command("security", args...).Output()
 	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+		return false, err
 	}
+	return strings.Contains(strings.ToLower(string(output)), certFingerprint(cert)), nil
+}
 
-	return nil
+func installCertLinux(cert *x509.Certificate, certPath string) error {
+	err := installSystemCertLinux(cert, certPath)
+	installExtraTrustStores(cert, certPath)
+	return err
+}
+
+func uninstallCertificate(certPath string) error {
+	cert, err := loadCertPEM(certPath)
+	if err != nil {
+		return err
+	}
+	return uninstallCert(cert)
 }
 
 func printManualInstallInstructions(certPath string) {
@@ -3116,8 +12205,16 @@ func printManualInstallInstructions(certPath string) {
 	case "linux":
 		log.Println("")
 		log.Println("=== Manual Linux Installation ===")
-		log.Printf("  sudo cp \"%s\" /usr/local/share/ca-certificates/tlsproxy.crt", absPath)
-		log.Println("  sudo update-ca-certificates")
+		layout, err := detectLinuxTrustLayout()
+		switch {
+		case err != nil:
+			log.Printf("  (%v)", err)
+		case layout.AnchorDir == "":
+			log.Printf("  sudo trust anchor --store \"%s\"", absPath)
+		default:
+			log.Printf("  sudo cp \"%s\" %s", absPath, filepath.Join(layout.AnchorDir, linuxAnchorFile))
+			log.Printf("  sudo %s", strings.Join(layout.Refresh, " "))
+		}
 		log.Println("")
 	}
 }